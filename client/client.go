@@ -2,34 +2,106 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"hello-go/common"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/websocket"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// Config holds the options used to connect a WsClient.
+type Config struct {
+	// Host is the server name or IP address, defaults to `localhost`.
+	Host string
+	Port uint16
+	// URL is an optional server base URL (e.g. `https://[::1]:3000`) which overrides
+	// Host, Port and the TLS scheme.
+	URL string
+	// TLS uses https and wss when connecting to the server.
+	TLS bool
+	// CA is an optional path to a PEM file used to verify the server certificate.
+	// Setting CA implies TLS.
+	CA string
+	// Cert and Key are optional paths to a client certificate used to authenticate
+	// instead of a password. Setting them implies TLS.
+	Cert string
+	Key  string
+}
+
+// reconnectDelay is the delay before reconnecting after the connection is lost, which
+// doubles after each failed attempt up to maxReconnectDelay.
+const (
+	reconnectDelay    = time.Second
+	maxReconnectDelay = 30 * time.Second
 )
 
 type WsClient struct {
-	port uint16
+	cfg  Config
+	base *url.URL
+	tls  *tls.Config
 	conn *websocket.Conn
+	// room is where REPL input is sent, messages are broadcast when empty
+	room string
 	rx   chan common.Packet
 	tx   chan common.Packet
 	quit chan struct{}
+	// dropped receives the read error when the current connection is lost
+	dropped chan error
+	outbox  outbox
+	// lastSent is the id of the last message the server acknowledged, and lastSeen of
+	// the last message received, used when commands omit the message id
+	lastSent atomic.Int64
+	lastSeen atomic.Int64
 }
 
-func New(port uint16) *WsClient {
-	return &WsClient{
-		port: port,
+func New(cfg Config) (*WsClient, error) {
+	c := &WsClient{
+		cfg:  cfg,
 		rx:   make(chan common.Packet),
 		tx:   make(chan common.Packet),
 		quit: make(chan struct{}),
 	}
+
+	base, err := baseURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.base = base
+	if base.Scheme == "https" {
+		cfg.TLS = true
+	}
+
+	if cfg.TLS || cfg.CA != "" || cfg.Cert != "" {
+		c.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.CA != "" {
+			pool, err := common.LoadCertPool(cfg.CA)
+			if err != nil {
+				return nil, err
+			}
+			c.tls.RootCAs = pool
+		}
+		if cfg.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+			if err != nil {
+				return nil, err
+			}
+			c.tls.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	return c, nil
 }
 
 func (c *WsClient) Close() {
@@ -56,37 +128,108 @@ func (c *WsClient) LocalAddr() net.Addr {
 	panic("connection is nil")
 }
 
+// Run connects to the server and runs the REPL until it exits. A lost connection is
+// re-established, and messages the server has not acknowledged are sent again.
 func (c *WsClient) Run(user string, pass string) {
-	otp, err := c.authenticate(user, pass)
-	if err != nil {
+	defer c.Close()
+	if err := c.connect(user, pass); err != nil {
 		log.Error(err)
 		return
 	}
-	log.Debugf("received OTP from server: %s", otp)
+	go c.repl()
+
+	for c.msgLoop() {
+		c.Close()
+		if !c.reconnect(user, pass) {
+			break
+		}
+		c.resend()
+	}
+	if n := len(c.outbox.unacked()); n > 0 {
+		log.Warn("exiting before the server acknowledged every message", "unacknowledged", n)
+	}
+}
+
+// connect authenticates and opens the websocket.
+func (c *WsClient) connect(user string, pass string) error {
+	otp, err := c.authenticate(user, pass)
+	if err != nil {
+		return err
+	}
+	log.Debug("received OTP from server", "otp", common.Fingerprint(otp))
 
-	conn, _, err := websocket.DefaultDialer.Dial(
-		fmt.Sprintf("ws://localhost:%v/ws?otp=%s", c.port, otp),
-		map[string][]string{"Origin": {fmt.Sprintf("http://localhost:%d", c.port)}},
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		TLSClientConfig:  c.tls,
+	}
+	conn, _, err := dialer.Dial(
+		c.url("ws", "/ws?otp="+otp),
+		map[string][]string{"Origin": {c.origin()}},
 	)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	c.conn = conn
+	c.dropped = make(chan error, 1)
 	log.Infof("connected to %v", c.RemoteAddr().String())
-	defer c.Close()
-	go c.recv()
-	go c.repl()
-	c.msgLoop()
+	go c.recv(conn, c.dropped)
+	return nil
+}
+
+// reconnect connects again with backoff, returning false if the REPL exits first.
+func (c *WsClient) reconnect(user string, pass string) bool {
+	log.Warn("connection lost, reconnecting")
+	for delay := reconnectDelay; ; delay = min(2*delay, maxReconnectDelay) {
+		select {
+		case <-c.quit:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := c.connect(user, pass)
+		if err == nil {
+			return true
+		}
+		log.Error("failed to reconnect", "err", err)
+	}
+}
+
+// resend sends the messages which were not acknowledged before the connection was
+// lost. The server ignores those it already stored.
+func (c *WsClient) resend() {
+	pending := c.outbox.unacked()
+	if len(pending) > 0 {
+		log.Info("resending unacknowledged messages", "count", len(pending))
+	}
+	for _, t := range pending {
+		if err := common.WritePacket(c.conn, common.NewJSONPacket(common.PACKET_TEXT, t)); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
+
+// send assigns a message an id and adds it to the outbox until the server
+// acknowledges it.
+func (c *WsClient) send(t common.Text) common.Packet {
+	t.Id = gonanoid.Must()
+	c.outbox.add(t)
+	return common.NewJSONPacket(common.PACKET_TEXT, t)
 }
 
 func (c *WsClient) authenticate(user string, pass string) (string, error) {
 	log.Debug("requesting OTP from server")
 
-	url := fmt.Sprintf("http://localhost:%d/login", c.port)
-	r, _ := http.NewRequest("GET", url, nil)
+	r, _ := http.NewRequest("GET", c.url("http", "/login"), nil)
 	r.SetBasicAuth(user, pass)
-	client := http.Client{}
+	client := http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.tls,
+		},
+	}
 	resp, err := client.Do(r)
 	if err != nil {
 		return "", err
@@ -103,20 +246,84 @@ func (c *WsClient) authenticate(user string, pass string) (string, error) {
 	return string(otp), nil
 }
 
-func (c *WsClient) recv() {
-	for {
-		p, err := common.ReadPacket(c.conn)
-		if err != nil && err != common.ErrDisconnected {
-			log.Error(err)
-			break
+// baseURL resolves the server address from the config, accepting `http`, `https`,
+// `ws` and `wss` URLs or a bare host and port.
+func baseURL(cfg Config) (*url.URL, error) {
+	if cfg.URL == "" {
+		host := strings.Trim(cfg.Host, "[]")
+		if host == "" {
+			host = "localhost"
 		}
-		if p == nil {
-			break
+		return &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(cfg.Port))),
+		}, nil
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "http"
+	case "https", "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme `%s`", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("URL `%s` is missing a host", cfg.URL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u, nil
+}
+
+// url builds a server URL for `path`. The scheme is upgraded to its secure variant
+// (`https` or `wss`) when TLS is enabled.
+func (c *WsClient) url(scheme string, path string) string {
+	if c.tls != nil {
+		scheme += "s"
+	}
+
+	return fmt.Sprintf("%s://%s%s%s", scheme, c.base.Host, c.base.Path, path)
+}
+
+// origin is the value of the Origin header sent when opening the websocket.
+func (c *WsClient) origin() string {
+	scheme := "http"
+	if c.tls != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, c.base.Host)
+}
+
+func (c *WsClient) recv(conn *websocket.Conn, dropped chan<- error) {
+	for {
+		p, err := common.ReadPacket(conn)
+		if err != nil {
+			if !errors.Is(err, common.ErrDisconnected) {
+				log.Error(err)
+			}
+			dropped <- err
+			return
 		}
 		c.rx <- p
 	}
+}
 
-	c.quit <- struct{}{}
+// reconnectable reports whether the connection was lost, rather than closed by the
+// server because the user was kicked or banned.
+func reconnectable(err error) bool {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return true
+	}
+	return ce.Code != websocket.ClosePolicyViolation && ce.Code != websocket.CloseNormalClosure
 }
 
 func (c *WsClient) repl() {
@@ -141,26 +348,95 @@ func (c *WsClient) repl() {
 			break
 		}
 
-		c.tx <- &common.RawPacket{
-			Type:    "text",
-			Payload: []byte(input),
+		if input == "" {
+			continue
+		}
+		if strings.HasPrefix(input, "/") {
+			p, err := c.command(input)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if p != nil {
+				c.tx <- p
+			}
+			continue
 		}
+
+		c.tx <- c.send(common.Text{Room: c.room, Text: input})
 	}
 }
 
-func (c *WsClient) msgLoop() {
+func (c *WsClient) handle(p *common.RawPacket) {
+	switch p.Type {
+	case common.PACKET_NOTICE:
+		fmt.Printf("SERVER> %s\n", p.Payload)
+	case common.PACKET_EVENT:
+		var e common.Event
+		if err := p.Decode(&e); err != nil {
+			log.Error("invalid event", "err", err)
+			return
+		}
+		if e.Type == common.EVENT_MESSAGE {
+			c.lastSeen.Store(e.MessageId)
+		}
+		fmt.Println(formatEvent(e))
+	case common.PACKET_WHO:
+		var users []common.Presence
+		if err := p.Decode(&users); err != nil {
+			log.Error("invalid user list", "err", err)
+			return
+		}
+		fmt.Print(formatWho(users))
+	case common.PACKET_THREAD:
+		var t common.Thread
+		if err := p.Decode(&t); err != nil {
+			log.Error("invalid thread", "err", err)
+			return
+		}
+		fmt.Print(formatThread(t))
+	case common.PACKET_TYPING:
+		var sig common.Signal
+		if err := p.Decode(&sig); err != nil {
+			log.Error("invalid signal", "err", err)
+			return
+		}
+		fmt.Println(formatTyping(sig))
+	case common.PACKET_ACK:
+		var a common.Ack
+		if err := p.Decode(&a); err != nil {
+			log.Error("invalid ack", "err", err)
+			return
+		}
+		c.outbox.ack(a.Id)
+		if a.MessageId != 0 {
+			c.lastSent.Store(a.MessageId)
+		}
+		if a.Error != "" {
+			log.Error("message not sent", "err", a.Error)
+		} else if a.Duplicate {
+			log.Debug("message was already delivered", "id", a.Id, "message_id", a.MessageId)
+		}
+	}
+}
+
+// msgLoop handles packets until the REPL exits or the connection is lost, returning
+// whether to reconnect.
+func (c *WsClient) msgLoop() bool {
 	for {
 		select {
-		case <-c.rx:
-			// TODO: handle packet
+		case p := <-c.rx:
+			c.handle(p.(*common.RawPacket))
 		case p := <-c.tx:
 			if err := common.WritePacket(c.conn, p); err != nil {
 				log.Error(err)
-				return
+				return true
 			}
+		case err := <-c.dropped:
+			return reconnectable(err)
 		case <-c.quit:
 			log.Debugf("exiting message loop")
-			return
+			return false
 		}
 	}
 }
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection lost", io.ErrUnexpectedEOF, true},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, true},
+		{"abnormal closure", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, true},
+		{"kicked", &websocket.CloseError{Code: websocket.ClosePolicyViolation, Text: "kicked"}, false},
+		{"closed", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{"wrapped", errors.Join(errors.New("read failed"), &websocket.CloseError{Code: websocket.ClosePolicyViolation}), false},
+	}
+
+	for _, tt := range tests {
+		if got := reconnectable(tt.err); got != tt.want {
+			t.Errorf("%s: reconnectable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
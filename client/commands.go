@@ -0,0 +1,226 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hello-go/common"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// command handles a REPL line starting with `/`. Chat commands may change the client
+// state and return a nil packet, other commands are passed to parseCommand.
+func (c *WsClient) command(input string) (common.Packet, error) {
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "join":
+		if len(args) != 1 {
+			return nil, errors.New("usage: /join <room>")
+		}
+		room, err := common.NormalizeRoom(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.room = room
+		return &common.RawPacket{Type: common.PACKET_JOIN, Payload: []byte(room)}, nil
+
+	case "leave":
+		room := c.room
+		if len(args) > 0 {
+			room = args[0]
+		}
+		room, err := common.NormalizeRoom(room)
+		if err != nil {
+			return nil, errors.New("usage: /leave [room]")
+		}
+		if c.room == room {
+			c.room = ""
+		}
+		return &common.RawPacket{Type: common.PACKET_LEAVE, Payload: []byte(room)}, nil
+
+	case "room":
+		if len(args) == 0 {
+			fmt.Println(targetName(c.room))
+			return nil, nil
+		}
+		if args[0] == "*" {
+			c.room = ""
+			return nil, nil
+		}
+		room, err := common.NormalizeRoom(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.room = room
+		return nil, nil
+
+	case "msg":
+		if len(args) < 2 {
+			return nil, errors.New("usage: /msg <user> <text>")
+		}
+		text := afterFields(input, 2)
+		return c.send(common.Text{To: args[0], Text: text}), nil
+
+	case "reply":
+		if len(args) < 2 {
+			return nil, errors.New("usage: /reply <id> <text>")
+		}
+		id, err := messageId(args, 0, 0)
+		if err != nil {
+			return nil, fmt.Errorf("usage: /reply <id> <text>: %w", err)
+		}
+		// the server sends replies to the conversation of the thread
+		return c.send(common.Text{ParentId: id, Text: afterFields(input, 2)}), nil
+
+	case "thread":
+		id, err := messageId(args, 0, c.lastSeen.Load())
+		if err != nil {
+			return nil, fmt.Errorf("usage: /thread [id], defaults to the last message: %w", err)
+		}
+		return &common.RawPacket{Type: common.PACKET_THREAD, Payload: []byte(strconv.FormatInt(id, 10))}, nil
+
+	case "edit":
+		if len(args) < 1 {
+			return nil, errors.New("usage: /edit <text>, edits your last message")
+		}
+		id := c.lastSent.Load()
+		if id == 0 {
+			return nil, errors.New("no message to edit")
+		}
+		return common.NewJSONPacket(common.PACKET_EDIT, common.Edit{MessageId: id, Text: afterFields(input, 1)}), nil
+
+	case "delete":
+		id, err := messageId(args, 0, c.lastSent.Load())
+		if err != nil {
+			return nil, fmt.Errorf("usage: /delete [id], defaults to your last message: %w", err)
+		}
+		return common.NewJSONPacket(common.PACKET_DELETE, common.Delete{MessageId: id}), nil
+
+	case "react", "unreact":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("usage: /%s <emoji> [id]", name)
+		}
+		id, err := messageId(args, 1, c.lastSeen.Load())
+		if err != nil {
+			return nil, fmt.Errorf("usage: /%s <emoji> [id], defaults to the last message: %w", name, err)
+		}
+		r := common.Reaction{MessageId: id, Emoji: args[0], Remove: name == "unreact"}
+		return common.NewJSONPacket(common.PACKET_REACT, r), nil
+
+	case "who":
+		return &common.RawPacket{Type: common.PACKET_WHO}, nil
+
+	case "away":
+		return statusPacket(common.PRESENCE_AWAY, input, len(args) > 0), nil
+
+	case "back":
+		return common.NewJSONPacket(common.PACKET_STATUS, common.StatusUpdate{Status: common.PRESENCE_ONLINE}), nil
+
+	case "status":
+		return statusPacket("", input, true), nil
+	}
+
+	return parseCommand(input)
+}
+
+// afterFields returns the text of `input` following its first `n` fields, keeping the
+// original spacing.
+func afterFields(input string, n int) string {
+	s := strings.TrimSpace(input)
+	for i := 0; i < n; i++ {
+		j := strings.IndexFunc(s, unicode.IsSpace)
+		if j < 0 {
+			return ""
+		}
+		s = strings.TrimLeftFunc(s[j:], unicode.IsSpace)
+	}
+	return s
+}
+
+// messageId parses the optional message id in args[i], returning `last` when it is
+// missing.
+func messageId(args []string, i int, last int64) (int64, error) {
+	if len(args) <= i {
+		if last == 0 {
+			return 0, errors.New("no message yet")
+		}
+		return last, nil
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[i], "#"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid message id `%s`", args[i])
+	}
+	return id, nil
+}
+
+// statusPacket builds a status update, setting the status message to the text after
+// the command when `withMessage` is set. `/status` without text clears the message.
+func statusPacket(status string, input string, withMessage bool) common.Packet {
+	u := common.StatusUpdate{Status: status}
+	if withMessage {
+		msg := afterFields(input, 1)
+		u.Message = &msg
+	}
+	return common.NewJSONPacket(common.PACKET_STATUS, u)
+}
+
+func targetName(room string) string {
+	if room == "" {
+		return "sending to everyone"
+	}
+	return "sending to #" + room
+}
+
+// parseCommand converts a REPL line starting with `/` into a packet, e.g.
+// `/mute bob 10m spamming`.
+func parseCommand(input string) (common.Packet, error) {
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "kick", "unmute", "unban":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("usage: /%s <target> [reason]", name)
+		}
+		return commandPacket(name, args[0], "", args[1:]), nil
+
+	case "mute":
+		if len(args) < 2 {
+			return nil, errors.New("usage: /mute <user> <duration> [reason]")
+		}
+		return commandPacket(name, args[0], args[1], args[2:]), nil
+
+	case "ban":
+		if len(args) < 1 {
+			return nil, errors.New("usage: /ban <user|ip|cidr> [duration] [reason]")
+		}
+		duration := ""
+		if len(args) > 1 {
+			if _, err := time.ParseDuration(args[1]); err == nil {
+				duration, args = args[1], append(args[:1], args[2:]...)
+			}
+		}
+		return commandPacket(name, args[0], duration, args[1:]), nil
+	}
+
+	return nil, fmt.Errorf("unknown command `/%s`", name)
+}
+
+func commandPacket(action string, target string, duration string, reason []string) common.Packet {
+	return common.NewJSONPacket(common.PACKET_COMMAND, common.Command{
+		Action:   action,
+		Target:   target,
+		Duration: duration,
+		Reason:   strings.Join(reason, " "),
+	})
+}
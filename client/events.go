@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"hello-go/common"
+	"strings"
+)
+
+// replyIndent indents replies under the message they reply to.
+const replyIndent = "    ↳ "
+
+// formatEvent renders an event for the terminal.
+func formatEvent(e common.Event) string {
+	ts := e.Time.Local().Format("15:04")
+
+	// messages are prefixed with their id, which commands such as `/react` refer to
+	if e.MessageId != 0 {
+		ts = fmt.Sprintf("%s [%d]", ts, e.MessageId)
+	}
+
+	switch e.Type {
+	case common.EVENT_MESSAGE:
+		if e.ParentId != 0 {
+			return fmt.Sprintf("%s%s (reply to [%d])", replyIndent, formatMessage(ts, e), e.ParentId)
+		}
+		return formatMessage(ts, e)
+	case common.EVENT_EDIT:
+		return fmt.Sprintf("%s * %s edited: %s", ts, e.By, e.Text)
+	case common.EVENT_DELETE:
+		if e.By != e.User {
+			return fmt.Sprintf("%s * message from %s deleted by %s", ts, e.User, e.By)
+		}
+		return fmt.Sprintf("%s * %s deleted their message", ts, e.By)
+	case common.EVENT_REACT:
+		return fmt.Sprintf("%s * %s reacted %s (%d)", ts, e.By, e.Emoji, e.Count)
+	case common.EVENT_UNREACT:
+		return fmt.Sprintf("%s * %s removed %s (%d)", ts, e.By, e.Emoji, e.Count)
+	case common.EVENT_JOIN:
+		return fmt.Sprintf("%s * %s joined #%s", ts, e.User, e.Room)
+	case common.EVENT_LEAVE:
+		return fmt.Sprintf("%s * %s left #%s", ts, e.User, e.Room)
+	case common.EVENT_PRESENCE:
+		if e.Text != "" {
+			return fmt.Sprintf("%s * %s is %s: %s", ts, e.User, e.Status, e.Text)
+		}
+		return fmt.Sprintf("%s * %s is %s", ts, e.User, e.Status)
+	}
+
+	return fmt.Sprintf("%s * %s: %s", ts, e.Type, e.User)
+}
+
+func formatMessage(ts string, e common.Event) string {
+	if e.Bot {
+		e.User += " [bot]"
+	}
+	switch {
+	case e.To != "" && e.Queued:
+		return fmt.Sprintf("%s [dm] %s -> %s> %s (queued)", ts, e.User, e.To, e.Text)
+	case e.To != "":
+		return fmt.Sprintf("%s [dm] %s -> %s> %s", ts, e.User, e.To, e.Text)
+	case e.Room != "":
+		return fmt.Sprintf("%s #%s %s> %s", ts, e.Room, e.User, e.Text)
+	default:
+		return fmt.Sprintf("%s %s> %s", ts, e.User, e.Text)
+	}
+}
+
+// formatThread renders the reply to `/thread`, the root message followed by its replies
+// indented below it, oldest first.
+func formatThread(t common.Thread) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%d replies)\n", formatEvent(messageEvent(t.Parent)), t.Parent.Replies)
+	if t.NextBefore != 0 {
+		fmt.Fprintf(&b, "%s...\n", replyIndent)
+	}
+	for i := len(t.Replies) - 1; i >= 0; i-- {
+		e := messageEvent(t.Replies[i])
+		e.ParentId = 0
+		fmt.Fprintf(&b, "%s%s\n", replyIndent, formatEvent(e))
+	}
+	return b.String()
+}
+
+// messageEvent converts a stored message into the event it was delivered as.
+func messageEvent(m common.Message) common.Event {
+	e := common.Event{
+		Type:      common.EVENT_MESSAGE,
+		Time:      m.Time,
+		User:      m.From,
+		Room:      m.Room,
+		To:        m.To,
+		Text:      m.Text,
+		MessageId: m.Id,
+		Bot:       m.Bot,
+		ParentId:  m.ParentId,
+	}
+	if m.Deleted != nil {
+		e.Text = "(deleted)"
+	}
+	return e
+}
+
+// formatTyping renders a typing signal. Stops and read cursors are not shown, since the
+// REPL cannot take back a line once it is printed.
+func formatTyping(sig common.Signal) string {
+	if sig.Room != "" {
+		return fmt.Sprintf("* %s is typing in #%s", sig.User, sig.Room)
+	}
+	return fmt.Sprintf("* %s is typing", sig.User)
+}
+
+// formatWho renders the reply to `/who`, one user per line.
+func formatWho(users []common.Presence) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d online\n", len(users))
+	for _, u := range users {
+		fmt.Fprintf(&b, "  %s (%s", u.User, u.Status)
+		if u.Sessions > 1 {
+			fmt.Fprintf(&b, ", %d sessions", u.Sessions)
+		}
+		b.WriteString(")")
+		if u.Message != "" {
+			fmt.Fprintf(&b, " %s", u.Message)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"hello-go/common"
+	"slices"
+	"sync"
+)
+
+// outbox holds the messages sent from the REPL until the server acknowledges them, in
+// the order they were sent.
+type outbox struct {
+	sync.Mutex
+	pending []common.Text
+}
+
+func (o *outbox) add(t common.Text) {
+	o.Lock()
+	defer o.Unlock()
+	o.pending = append(o.pending, t)
+}
+
+// ack removes an acknowledged message, returning false if it was not pending.
+func (o *outbox) ack(id string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	i := slices.IndexFunc(o.pending, func(t common.Text) bool { return t.Id == id })
+	if i < 0 {
+		return false
+	}
+	o.pending = slices.Delete(o.pending, i, i+1)
+	return true
+}
+
+// unacked returns a copy of the pending messages.
+func (o *outbox) unacked() []common.Text {
+	o.Lock()
+	defer o.Unlock()
+	return slices.Clone(o.pending)
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"hello-go/common"
+	"testing"
+)
+
+func TestOutboxKeepsUnackedInOrder(t *testing.T) {
+	var o outbox
+	for _, id := range []string{"a", "b", "c"} {
+		o.add(common.Text{Id: id, Text: "hello " + id})
+	}
+
+	if !o.ack("b") {
+		t.Error("ack of a pending message returned false")
+	}
+	if o.ack("b") || o.ack("x") {
+		t.Error("ack of a message which is not pending returned true")
+	}
+
+	pending := o.unacked()
+	if len(pending) != 2 || pending[0].Id != "a" || pending[1].Id != "c" {
+		t.Fatalf("unacked messages are %v, want a and c in order", pending)
+	}
+	// the copy is not changed by later acks
+	o.ack("a")
+	if pending[0].Id != "a" || len(o.unacked()) != 1 {
+		t.Errorf("unacked messages are %v after acking a", o.unacked())
+	}
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	AUDIT_LOGIN           = "login"
+	AUDIT_LOGIN_FAILED    = "login_failed"
+	AUDIT_TOKEN_CREATE    = "token_create"
+	AUDIT_TOKEN_REVOKE    = "token_revoke"
+	AUDIT_USER_CREATE     = "user_create"
+	AUDIT_USER_DELETE     = "user_delete"
+	AUDIT_ROLE_CHANGE     = "role_change"
+	AUDIT_BAN             = "ban"
+	AUDIT_UNBAN           = "unban"
+	AUDIT_KICK            = "kick"
+	AUDIT_MUTE            = "mute"
+	AUDIT_UNMUTE          = "unmute"
+	AUDIT_WEBHOOK_CREATE  = "webhook_create"
+	AUDIT_WEBHOOK_DELETE  = "webhook_delete"
+	AUDIT_INCOMING_CREATE = "incoming_webhook_create"
+	AUDIT_INCOMING_DELETE = "incoming_webhook_delete"
+	AUDIT_MESSAGE_DELETE  = "message_delete"
+
+	AUDIT_STMT = `INSERT INTO audit_log (time, action, actor, target, ip, detail) VALUES (?, ?, ?, ?, ?, ?)`
+
+	auditPageSize = 100
+)
+
+type AuditEntry struct {
+	Id     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"`
+	Target string    `json:"target"`
+	IP     string    `json:"ip"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit entries, zero values match everything. Results are
+// returned newest first and BeforeId pages through older entries.
+type AuditFilter struct {
+	Action   string
+	Actor    string
+	Target   string
+	Since    time.Time
+	Until    time.Time
+	BeforeId int64
+	Limit    int
+}
+
+// Audit appends an entry to the audit log. Failures are logged rather than returned so
+// auditing never interrupts the action being recorded.
+func (d *Database) Audit(e AuditEntry) {
+	defer d.observe("audit", time.Now())
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	_, err := d.db.Exec(AUDIT_STMT, e.Time.Unix(), e.Action, e.Actor, e.Target, e.IP, e.Detail)
+	if err != nil {
+		log.Error("failed to write audit log", "err", err, "action", e.Action, "actor", e.Actor)
+	}
+}
+
+func (d *Database) GetAudit(f AuditFilter) ([]AuditEntry, error) {
+	defer d.observe("get_audit", time.Now())
+
+	if f.Limit <= 0 || f.Limit > auditPageSize {
+		f.Limit = auditPageSize
+	}
+	entries := []AuditEntry{}
+	err := d.eachAudit(f, func(e AuditEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+
+	return entries, err
+}
+
+// ExportAudit writes every entry matching the filter as JSON lines, oldest first. The
+// filter limit is ignored.
+func (d *Database) ExportAudit(w io.Writer, f AuditFilter) error {
+	defer d.observe("export_audit", time.Now())
+
+	f.Limit = 0
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return d.eachAudit(f, func(e AuditEntry) error {
+		return enc.Encode(e)
+	})
+}
+
+// PruneAudit deletes entries older than `before`, returning the number removed.
+func (d *Database) PruneAudit(before time.Time) (int64, error) {
+	defer d.observe("prune_audit", time.Now())
+
+	res, err := d.db.Exec(`DELETE FROM audit_log WHERE time < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// eachAudit calls `fn` for every matching entry. Entries are newest first when the
+// filter has a limit and oldest first otherwise.
+func (d *Database) eachAudit(f AuditFilter, fn func(AuditEntry) error) error {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.Actor != "" {
+		add("actor = ?", f.Actor)
+	}
+	if f.Target != "" {
+		add("target = ?", f.Target)
+	}
+	if !f.Since.IsZero() {
+		add("time >= ?", f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		add("time < ?", f.Until.Unix())
+	}
+	if f.BeforeId > 0 {
+		add("id < ?", f.BeforeId)
+	}
+
+	query := `SELECT id, time, action, actor, target, ip, detail FROM audit_log`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if f.Limit > 0 {
+		query += " ORDER BY id DESC LIMIT ?"
+		args = append(args, f.Limit)
+	} else {
+		query += " ORDER BY id"
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		var t int64
+		if err = rows.Scan(&e.Id, &t, &e.Action, &e.Actor, &e.Target, &e.IP, &e.Detail); err != nil {
+			return err
+		}
+		e.Time = time.Unix(t, 0)
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	BAN_USER = "user"
+	BAN_IP   = "ip"
+
+	CREATE_BAN_STMT = `INSERT INTO bans (kind, value, reason, created_by, created, expires) VALUES (?, ?, ?, ?, ?, ?)`
+	ACTIVE_BAN_COND = `(expires IS NULL OR expires > ?)`
+)
+
+type Ban struct {
+	Id        int64      `json:"id"`
+	Kind      string     `json:"kind"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason"`
+	CreatedBy string     `json:"created_by"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// NormalizeBan validates the ban kind and converts IP ban values to a masked CIDR
+// prefix. Single addresses become a /32 or /128 prefix.
+func NormalizeBan(b *Ban) error {
+	switch b.Kind {
+	case BAN_USER:
+		if b.Value == "" {
+			return errors.New("user ban requires a username")
+		}
+	case BAN_IP:
+		prefix, err := netip.ParsePrefix(b.Value)
+		if err != nil {
+			addr, err := netip.ParseAddr(b.Value)
+			if err != nil {
+				return fmt.Errorf("invalid IP address or range `%s`", b.Value)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		b.Value = prefix.Masked().String()
+	default:
+		return fmt.Errorf("unknown ban kind `%s`", b.Kind)
+	}
+
+	return nil
+}
+
+func (d *Database) CreateBan(b *Ban) error {
+	defer d.observe("create_ban", time.Now())
+	if err := NormalizeBan(b); err != nil {
+		return err
+	}
+
+	b.Created = time.Now().Truncate(time.Second)
+	var expires any
+	if b.Expires != nil {
+		t := b.Expires.Truncate(time.Second)
+		b.Expires = &t
+		expires = t.Unix()
+	}
+
+	res, err := d.db.Exec(CREATE_BAN_STMT, b.Kind, b.Value, b.Reason, b.CreatedBy, b.Created.Unix(), expires)
+	if err != nil {
+		return err
+	}
+	b.Id, err = res.LastInsertId()
+
+	return err
+}
+
+// DeleteBan removes a ban, returning false if it did not exist.
+func (d *Database) DeleteBan(id int64) (bool, error) {
+	defer d.observe("delete_ban", time.Now())
+
+	res, err := d.db.Exec(`DELETE FROM bans WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// GetBans returns every ban which has not expired.
+func (d *Database) GetBans() ([]Ban, error) {
+	defer d.observe("get_bans", time.Now())
+	return d.queryBans(`SELECT * FROM bans WHERE `+ACTIVE_BAN_COND+` ORDER BY id`, time.Now().Unix())
+}
+
+// FindBan returns an active ban matching the user or IP address, or nil if there is
+// none. Either argument may be empty.
+func (d *Database) FindBan(user string, ip netip.Addr) (*Ban, error) {
+	defer d.observe("find_ban", time.Now())
+	now := time.Now().Unix()
+
+	if user != "" {
+		bans, err := d.queryBans(
+			`SELECT * FROM bans WHERE kind = ? AND value = ? AND `+ACTIVE_BAN_COND+` LIMIT 1`,
+			BAN_USER, user, now,
+		)
+		if err != nil || len(bans) > 0 {
+			return first(bans), err
+		}
+	}
+
+	if !ip.IsValid() {
+		return nil, nil
+	}
+	bans, err := d.queryBans(`SELECT * FROM bans WHERE kind = ? AND `+ACTIVE_BAN_COND, BAN_IP, now)
+	if err != nil {
+		return nil, err
+	}
+	ip = ip.Unmap()
+	for _, b := range bans {
+		prefix, err := netip.ParsePrefix(b.Value)
+		if err == nil && prefix.Contains(ip) {
+			return &b, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (d *Database) queryBans(query string, args ...any) ([]Ban, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []Ban{}
+	for rows.Next() {
+		var b Ban
+		var created int64
+		var expires sql.NullInt64
+		if err = rows.Scan(&b.Id, &b.Kind, &b.Value, &b.Reason, &b.CreatedBy, &created, &expires); err != nil {
+			return nil, err
+		}
+		b.Created = time.Unix(created, 0)
+		if expires.Valid {
+			t := time.Unix(expires.Int64, 0)
+			b.Expires = &t
+		}
+		bans = append(bans, b)
+	}
+
+	return bans, rows.Err()
+}
+
+func first[T any](s []T) *T {
+	if len(s) == 0 {
+		return nil
+	}
+	return &s[0]
+}
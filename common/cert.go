@@ -0,0 +1,213 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	CA_CERT_FILE     = "ca.pem"
+	CA_KEY_FILE      = "ca.key"
+	SERVER_CERT_FILE = "server.pem"
+	SERVER_KEY_FILE  = "server.key"
+
+	caValidFor   = time.Hour * 24 * 365 * 10
+	leafValidFor = time.Hour * 24 * 365
+)
+
+// CertPair is a parsed certificate with its private key.
+type CertPair struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// GenCA creates a self-signed certificate authority for development use.
+func GenCA(name string) (*CertPair, error) {
+	tmpl, err := certTemplate(name, caValidFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	return signCert(tmpl, nil)
+}
+
+// IssueServerCert creates a certificate signed by the CA which is valid for the given
+// host names and IP addresses.
+func (ca *CertPair) IssueServerCert(hosts []string) (*CertPair, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("server certificate requires at least one host")
+	}
+
+	tmpl, err := certTemplate(hosts[0], leafValidFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	return signCert(tmpl, ca)
+}
+
+// IssueClientCert creates a certificate signed by the CA which authenticates as `user`.
+// The user name is stored in the subject common name.
+func (ca *CertPair) IssueClientCert(user string) (*CertPair, error) {
+	if user == "" {
+		return nil, errors.New("client certificate requires a user name")
+	}
+
+	tmpl, err := certTemplate(user, leafValidFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return signCert(tmpl, ca)
+}
+
+// WriteFiles saves the certificate and key as PEM files. The key file is only readable
+// by the current user.
+func (c *CertPair) WriteFiles(certPath string, keyPath string) error {
+	keyBytes, err := x509.MarshalECPrivateKey(c.Key)
+	if err != nil {
+		return err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+	if err = os.WriteFile(certPath, certPem, 0644); err != nil {
+		return err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	if err = os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		return err
+	}
+
+	log.Infof("wrote `%s` and `%s`", certPath, keyPath)
+	return nil
+}
+
+// LoadCertPair reads a PEM encoded certificate and EC private key from disk.
+func LoadCertPair(certPath string, keyPath string) (*CertPair, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key must be an ECDSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertPair{Cert: cert, Key: key}, nil
+}
+
+// LoadCA reads an existing CA from `dir`.
+func LoadCA(dir string) (*CertPair, error) {
+	return LoadCertPair(filepath.Join(dir, CA_CERT_FILE), filepath.Join(dir, CA_KEY_FILE))
+}
+
+// LoadOrGenCA reads the CA from `dir`, creating a new one if it does not exist.
+func LoadOrGenCA(dir string) (*CertPair, error) {
+	certPath := filepath.Join(dir, CA_CERT_FILE)
+	keyPath := filepath.Join(dir, CA_KEY_FILE)
+
+	if _, err := os.Stat(certPath); err == nil {
+		log.Debugf("using existing CA `%s`", certPath)
+		return LoadCA(dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ca, err := GenCA("hello-go development CA")
+	if err != nil {
+		return nil, err
+	}
+	if err = ca.WriteFiles(certPath, keyPath); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// LoadCertPool reads one or more PEM encoded certificates into a pool.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+
+	return pool, nil
+}
+
+func certTemplate(name string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"hello-go"}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+// signCert creates a new key for `tmpl` and signs it with `ca`, or self-signs if `ca`
+// is nil.
+func signCert(tmpl *x509.Certificate, ca *CertPair) (*CertPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertPair{Cert: cert, Key: key}, nil
+}
@@ -2,27 +2,48 @@ package common
 
 import (
 	"database/sql"
-	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 	gonanoid "github.com/matoous/go-nanoid/v2"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 const (
 	DB_CONNECTION_STR = "db.sqlite"
 	AUTH_STMT         = `SELECT salt, hash, count FROM users WHERE username = ? LIMIT 1`
-	CREATE_USER_STMT  = `INSERT INTO users VALUES (?, ?, ?, ?)`
+	CREATE_USER_STMT  = `INSERT INTO users (username, salt, hash, count) VALUES (?, ?, ?, ?)`
 	CREATE_TOKEN_STMT = `INSERT INTO tokens VALUES (?, ?)`
 	CHECK_TOKEN_STMT  = `SELECT COUNT(*) FROM tokens WHERE key = ?`
+	USER_EXISTS_STMT  = `SELECT COUNT(*) FROM users WHERE username = ?`
+	TOKEN_USER_STMT   = `SELECT owner FROM tokens WHERE key = ? LIMIT 1`
+	USER_ROLE_STMT    = `SELECT role FROM users WHERE username = ? LIMIT 1`
+
+	ROLE_USER  = "user"
+	ROLE_ADMIN = "admin"
+
+	MAX_USERNAME_LEN = 32
+
+	// FTS_MIGRATION_SUFFIX marks migrations which require FTS5.
+	FTS_MIGRATION_SUFFIX = "_fts.sql"
 )
 
-var Migrations embed.FS
+var ErrUserExists = errors.New("user already exists")
+
+// Migrations holds the `sql/*.sql` migration scripts.
+var Migrations fs.FS
 
 type Database struct {
 	db *sql.DB
+	// search is set when the messages_fts index exists
+	search bool
+	// OnQuery is called with the name and duration of every query when set.
+	OnQuery func(query string, elapsed time.Duration)
 }
 
 type UserData struct {
@@ -30,53 +51,94 @@ type UserData struct {
 	Salt  string `json:"salt"`
 	Hash  string `json:"hash"`
 	Count uint32 `json:"iter"`
+	Role  string `json:"role"`
 }
 
 func CreateDb() {
 	log.Infof("creating new database `%s`", DB_CONNECTION_STR)
-	os.Remove(DB_CONNECTION_STR)
-	db, err := sql.Open("sqlite3", DB_CONNECTION_STR)
+	db, err := NewDatabase(DB_CONNECTION_STR, Migrations)
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
+	if !db.search {
+		log.Warnf("%v, message search is disabled", ErrNoFTS5)
+	}
 
-	// execute migration scripts
-	err = fs.WalkDir(Migrations, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
+	log.Info("successfully created database")
+}
+
+// NewDatabase creates a database at `path` from the `sql/*.sql` migrations, replacing
+// any existing file. Migrations ending in FTS_MIGRATION_SUFFIX create the search index
+// and are skipped when SQLite was built without FTS5.
+func NewDatabase(path string, migrations fs.FS) (*Database, error) {
+	os.Remove(path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	fts := checkFTS5(db) == nil
+
+	// execute migration scripts, Glob returns them in order
+	files, err := fs.Glob(migrations, "sql/*.sql")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, path := range files {
+		if !fts && strings.HasSuffix(path, FTS_MIGRATION_SUFFIX) {
+			log.Debugf("skipping migration `%s` without FTS5", path)
+			continue
 		}
 
 		log.Debugf("executing migration `%s`", path)
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return err
+		data, err := fs.ReadFile(migrations, path)
+		if err == nil {
+			_, err = db.Exec(string(data))
 		}
-
-		_, err = db.Exec(string(data))
 		if err != nil {
-			panic(err)
+			db.Close()
+			return nil, fmt.Errorf("migration `%s`: %w", path, err)
 		}
+	}
 
-		return nil
-	})
+	return openDatabase(db)
+}
+
+func DbConnect() *Database {
+	db, err := OpenDatabase(DB_CONNECTION_STR)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Info("successfully created database")
+	return db
 }
 
-func DbConnect() *Database {
-	db, err := sql.Open("sqlite3", DB_CONNECTION_STR)
+// OpenDatabase opens an existing database. Message search is enabled when SQLite was
+// built with FTS5 and the database has the search index.
+func OpenDatabase(path string) (*Database, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return openDatabase(db)
+}
+
+func openDatabase(db *sql.DB) (*Database, error) {
+	var index bool
+	err := db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE name = 'messages_fts'`).Scan(&index)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	fts := checkFTS5(db) == nil
+	if index && !fts {
+		// the triggers keeping the index in sync would fail every message insert
+		db.Close()
+		return nil, fmt.Errorf("the database has a search index: %w", ErrNoFTS5)
 	}
 
-	return &Database{db: db}
+	return &Database{db: db, search: index}, nil
 }
 
 func (d *Database) Close() {
@@ -86,11 +148,29 @@ func (d *Database) Close() {
 	}
 }
 
+// observe reports the duration of a query to OnQuery, use with
+// `defer d.observe(name, time.Now())`.
+func (d *Database) observe(query string, start time.Time) {
+	if d.OnQuery != nil {
+		d.OnQuery(query, time.Since(start))
+	}
+}
+
+// Ping checks that the database is reachable.
+func (d *Database) Ping() error {
+	defer d.observe("ping", time.Now())
+	return d.db.Ping()
+}
+
 func (d *Database) CreateUser(user string, pass string) error {
+	defer d.observe("create_user", time.Now())
 	log.Debugf("creating user `%s`", user)
 
 	salt, hash, count := GenCreds(pass)
 	_, err := d.db.Exec(CREATE_USER_STMT, user, salt, hash, count)
+	if isConstraintErr(err) {
+		return ErrUserExists
+	}
 	if err != nil {
 		return err
 	}
@@ -98,7 +178,33 @@ func (d *Database) CreateUser(user string, pass string) error {
 	return nil
 }
 
+// ValidateUsername checks that `user` is a usable account name: non-empty, at most
+// MAX_USERNAME_LEN characters of letters, digits, `.`, `_` or `-`, and not reserved.
+func ValidateUsername(user string) error {
+	switch {
+	case user == "":
+		return errors.New("username must not be empty")
+	case user == "guest":
+		return errors.New("`guest` is a reserved name and cannot be used")
+	case len(user) > MAX_USERNAME_LEN:
+		return fmt.Errorf("username must be at most %d characters", MAX_USERNAME_LEN)
+	}
+	for _, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("username contains invalid character `%c`", c)
+		}
+	}
+
+	return nil
+}
+
+func isConstraintErr(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && e.Code == sqlite3.ErrConstraint
+}
+
 func (d *Database) CreateToken(user string) (string, error) {
+	defer d.observe("create_token", time.Now())
 	log.Debugf("creating token for `%s`", user)
 
 	token, err := gonanoid.New(30)
@@ -115,6 +221,7 @@ func (d *Database) CreateToken(user string) (string, error) {
 }
 
 func (d *Database) IsValidToken(token string) bool {
+	defer d.observe("check_token", time.Now())
 	if token == "" {
 		return false
 	}
@@ -129,7 +236,105 @@ func (d *Database) IsValidToken(token string) bool {
 	return count == 1
 }
 
+// TokenUser returns the owner of a token, or an empty string if the token is invalid.
+func (d *Database) TokenUser(token string) string {
+	defer d.observe("token_user", time.Now())
+	if token == "" {
+		return ""
+	}
+
+	var user string
+	err := d.db.QueryRow(TOKEN_USER_STMT, token).Scan(&user)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+	}
+
+	return user
+}
+
+// RevokeToken deletes a token, returning false if it did not exist.
+func (d *Database) RevokeToken(token string) (bool, error) {
+	defer d.observe("revoke_token", time.Now())
+
+	res, err := d.db.Exec(`DELETE FROM tokens WHERE key = ?`, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// DeleteUser removes a user and their tokens, returning false if the user did not
+// exist.
+func (d *Database) DeleteUser(user string) (bool, error) {
+	defer d.observe("delete_user", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// foreign keys are not enforced, so rows referencing the user are removed here
+	if _, err = tx.Exec(`DELETE FROM tokens WHERE owner = ?`, user); err != nil {
+		return false, err
+	}
+	// a new account with the same name must not inherit the room history
+	if _, err = tx.Exec(`DELETE FROM room_members WHERE username = ?`, user); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM presence WHERE username = ?`, user); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM offline_queue WHERE recipient = ?`, user); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM reactions WHERE username = ?`, user); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE username = ?`, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, tx.Commit()
+}
+
+// SetRole changes a user's role, returning false if the user does not exist.
+func (d *Database) SetRole(user string, role string) (bool, error) {
+	defer d.observe("set_role", time.Now())
+	if role != ROLE_USER && role != ROLE_ADMIN {
+		return false, fmt.Errorf("unknown role `%s`", role)
+	}
+
+	res, err := d.db.Exec(`UPDATE users SET role = ? WHERE username = ?`, role, user)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+func (d *Database) IsAdmin(user string) bool {
+	defer d.observe("user_role", time.Now())
+
+	var role string
+	err := d.db.QueryRow(USER_ROLE_STMT, user).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error(err)
+	}
+
+	return role == ROLE_ADMIN
+}
+
 func (d *Database) GetUsers() ([]string, error) {
+	defer d.observe("get_users", time.Now())
 	rows, err := d.db.Query(`SELECT username FROM users`)
 	if err != nil {
 		return nil, err
@@ -149,10 +354,11 @@ func (d *Database) GetUsers() ([]string, error) {
 }
 
 func (d *Database) UserInfo(user string) (*UserData, error) {
-	var name, salt, hash string
+	defer d.observe("user_info", time.Now())
+	var name, salt, hash, role string
 	var count uint32
-	err := d.db.QueryRow(`SELECT * FROM users WHERE username = ?`, user).
-		Scan(&name, &salt, &hash, &count)
+	err := d.db.QueryRow(`SELECT username, salt, hash, count, role FROM users WHERE username = ?`, user).
+		Scan(&name, &salt, &hash, &count, &role)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -165,10 +371,28 @@ func (d *Database) UserInfo(user string) (*UserData, error) {
 		Salt:  salt,
 		Hash:  hash,
 		Count: count,
+		Role:  role,
 	}, nil
 }
 
+func (d *Database) UserExists(user string) bool {
+	defer d.observe("user_exists", time.Now())
+	if user == "" {
+		return false
+	}
+
+	var count int
+	err := d.db.QueryRow(USER_EXISTS_STMT, user).Scan(&count)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	return count == 1
+}
+
 func (d *Database) AuthUser(user string, pass string) bool {
+	defer d.observe("auth_user", time.Now())
 	log.Debugf("authenticating user `%s`", user)
 
 	var saltStr, hash string
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const MAX_EMOJI_LEN = 32
+
+// Edit is the payload of a PACKET_EDIT packet, replacing the text of a message.
+type Edit struct {
+	MessageId int64  `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+// Delete is the payload of a PACKET_DELETE packet.
+type Delete struct {
+	MessageId int64 `json:"message_id"`
+}
+
+// Reaction is the payload of a PACKET_REACT packet, adding the emoji to a message or
+// removing it when Remove is set.
+type Reaction struct {
+	MessageId int64  `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove,omitempty"`
+}
+
+// GetMessage returns the message with the id if `viewer` was entitled to receive it,
+// or nil. Any message is returned when `viewer` is empty.
+func (d *Database) GetMessage(id int64, viewer string) (*Message, error) {
+	defer d.observe("get_message", time.Now())
+
+	query := `SELECT ` + MESSAGE_COLUMNS + ` FROM messages m WHERE m.id = ?`
+	args := []any{id}
+	if viewer != "" {
+		query += ` AND ` + VISIBLE_MESSAGE_COND
+		args = append(args, viewer, viewer, viewer, viewer)
+	}
+	m, err := scanMessage(d.db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, d.loadReactions([]*Message{m})
+}
+
+// EditMessage replaces the text of a message. It returns ErrMessageDeleted if the
+// message was deleted.
+func (d *Database) EditMessage(m *Message, text string) error {
+	defer d.observe("edit_message", time.Now())
+
+	now := time.Now().Truncate(time.Second)
+	res, err := d.db.Exec(
+		`UPDATE messages SET text = ?, edited = ? WHERE id = ? AND deleted IS NULL`, text, now.Unix(), m.Id,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMessageDeleted
+	}
+	m.Text = text
+	m.Edited = &now
+
+	return nil
+}
+
+// DeleteMessage turns a message into a tombstone, clearing its text and reactions. It
+// returns ErrMessageDeleted if the message was already deleted.
+func (d *Database) DeleteMessage(m *Message, by string) error {
+	defer d.observe("delete_message", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Truncate(time.Second)
+	res, err := tx.Exec(
+		`UPDATE messages SET text = '', deleted = ?, deleted_by = ? WHERE id = ? AND deleted IS NULL`, now.Unix(), by, m.Id,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMessageDeleted
+	}
+	if _, err = tx.Exec(`DELETE FROM reactions WHERE message_id = ?`, m.Id); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	m.Text = ""
+	m.Deleted = &now
+	m.DeletedBy = by
+	m.Reactions = nil
+
+	return nil
+}
+
+// React adds or removes a reaction of `user`, returning whether it changed and the
+// number of users who reacted with the emoji afterwards. Reactions cannot be added to
+// deleted messages, ErrMessageDeleted is returned instead.
+func (d *Database) React(id int64, user string, emoji string, remove bool) (bool, int, error) {
+	defer d.observe("react", time.Now())
+
+	var err error
+	var res sql.Result
+	if remove {
+		res, err = d.db.Exec(`DELETE FROM reactions WHERE message_id = ? AND username = ? AND emoji = ?`, id, user, emoji)
+	} else {
+		res, err = d.db.Exec(
+			`INSERT OR IGNORE INTO reactions (message_id, username, emoji, time)
+			SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM messages WHERE id = ? AND deleted IS NULL)`,
+			id, user, emoji, time.Now().Unix(), id,
+		)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, 0, err
+	}
+	if n == 0 && !remove {
+		// the reaction already existed, or the message was deleted
+		var deleted bool
+		if err := d.db.QueryRow(`SELECT deleted IS NOT NULL FROM messages WHERE id = ?`, id).Scan(&deleted); err != nil {
+			return false, 0, err
+		}
+		if deleted {
+			return false, 0, ErrMessageDeleted
+		}
+	}
+
+	var count int
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM reactions WHERE message_id = ? AND emoji = ?`, id, emoji).Scan(&count)
+	return n > 0, count, err
+}
+
+// loadReactions sets the reaction counts of the messages.
+func (d *Database) loadReactions(messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byId := make(map[int64]*Message, len(messages))
+	args := make([]any, 0, len(messages))
+	for _, m := range messages {
+		byId[m.Id] = m
+		args = append(args, m.Id)
+	}
+	rows, err := d.db.Query(
+		`SELECT message_id, emoji, COUNT(*) FROM reactions WHERE message_id IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+		GROUP BY message_id, emoji`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var emoji string
+		var count int
+		if err := rows.Scan(&id, &emoji, &count); err != nil {
+			return err
+		}
+		m := byId[id]
+		if m.Reactions == nil {
+			m.Reactions = make(map[string]int)
+		}
+		m.Reactions[emoji] = count
+	}
+
+	return rows.Err()
+}
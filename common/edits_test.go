@@ -0,0 +1,37 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeletedMessageCannotChange(t *testing.T) {
+	d := newTestDatabase(t)
+	m := &Message{From: "alice", Text: "hello"}
+	if err := d.CreateMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	// a message found before it was deleted by another session
+	stale := *m
+	if err := d.DeleteMessage(m, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.EditMessage(&stale, "hi"); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("editing returned %v, want ErrMessageDeleted", err)
+	}
+	if _, _, err := d.React(m.Id, "bob", "👍", false); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("reacting returned %v, want ErrMessageDeleted", err)
+	}
+	if err := d.DeleteMessage(&stale, "carol"); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("deleting again returned %v, want ErrMessageDeleted", err)
+	}
+
+	got, err := d.GetMessage(m.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "" || got.DeletedBy != "alice" || len(got.Reactions) != 0 {
+		t.Errorf("tombstone changed to %+v", got)
+	}
+}
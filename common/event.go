@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_MESSAGE  = "message"
+	EVENT_JOIN     = "join"
+	EVENT_LEAVE    = "leave"
+	EVENT_PRESENCE = "presence"
+	EVENT_EDIT     = "edit"
+	EVENT_DELETE   = "delete"
+	EVENT_REACT    = "react"
+	EVENT_UNREACT  = "unreact"
+
+	MAX_ROOM_LEN = 32
+	MAX_TEXT_LEN = 4096
+)
+
+// Text is the payload of a PACKET_TEXT packet. A message with neither Room nor To is
+// broadcast to every connected user.
+type Text struct {
+	// Room is the name of a room the sender is a member of.
+	Room string `json:"room,omitempty"`
+	// To is the recipient of a direct message.
+	To   string `json:"to,omitempty"`
+	Text string `json:"text"`
+	// Id is an optional client assigned id. The server acknowledges the message with a
+	// PACKET_ACK carrying it, and does not store or deliver it again when it is resent.
+	Id string `json:"id,omitempty"`
+	// ParentId makes the message a reply in the thread of this message. Replies are
+	// sent to the room or direct conversation of the thread, so Room and To may be
+	// left out.
+	ParentId int64 `json:"parent_id,omitempty"`
+}
+
+// Event is sent to websocket peers in a PACKET_EVENT packet and to SSE subscribers.
+// Ids increase monotonically for the lifetime of the server.
+type Event struct {
+	Id   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	User string    `json:"user"`
+	Room string    `json:"room,omitempty"`
+	To   string    `json:"to,omitempty"`
+	// Text is the message text, or the status message of a presence event. It is the
+	// new text of an edit event.
+	Text   string `json:"text,omitempty"`
+	Status string `json:"status,omitempty"`
+	// MessageId is the stored message of a message event, or the message changed by
+	// an edit, delete or reaction event. User is then the author of the message and By
+	// the user who changed it.
+	MessageId int64  `json:"message_id,omitempty"`
+	By        string `json:"by,omitempty"`
+	// ParentId is the root message of the thread of a reply.
+	ParentId int64 `json:"parent_id,omitempty"`
+	// Emoji of a reaction event, and Count the users who reacted with it afterwards.
+	Emoji string `json:"emoji,omitempty"`
+	Count int    `json:"count,omitempty"`
+	// Bot is set for messages from incoming webhooks, User is then not a real user.
+	Bot bool `json:"bot,omitempty"`
+	// Queued is set for direct messages queued while the recipient was offline, both
+	// when sent and when delivered from the queue. Delivered events have no Id, as they
+	// were not published.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// NormalizeRoom lowercases a room name and strips a leading `#`, returning an error if
+// it is empty, longer than MAX_ROOM_LEN or contains characters other than letters,
+// digits, `_` or `-`.
+func NormalizeRoom(room string) (string, error) {
+	room = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(room), "#"))
+	switch {
+	case room == "":
+		return "", errors.New("room name must not be empty")
+	case len(room) > MAX_ROOM_LEN:
+		return "", fmt.Errorf("room name must be at most %d characters", MAX_ROOM_LEN)
+	}
+	for _, c := range room {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", fmt.Errorf("room name contains invalid character `%c`", c)
+		}
+	}
+
+	return room, nil
+}
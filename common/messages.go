@@ -0,0 +1,287 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	CREATE_MESSAGE_STMT = `INSERT INTO messages (time, sender, room, recipient, text, bot, client_id, parent_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	MESSAGE_COLUMNS     = `m.id, m.time, m.sender, m.room, m.recipient, m.text, m.bot, m.client_id, m.edited, m.deleted, m.deleted_by, m.parent_id, m.replies`
+
+	// VISIBLE_MESSAGE_COND matches messages the user in the four `?` arguments was
+	// entitled to receive: broadcasts, their direct messages, and room messages sent
+	// while they were a member of the room or sent by them. Bot senders are not users.
+	VISIBLE_MESSAGE_COND = `((m.room = '' AND m.recipient = '')
+		OR (m.recipient != '' AND (m.sender = ? OR m.recipient = ?))
+		OR (m.room != '' AND EXISTS (
+			SELECT 1 FROM room_members rm WHERE rm.room = m.room AND rm.username = ?
+			AND rm.joined <= m.time AND (rm.left IS NULL OR rm.left >= m.time)
+		))
+		OR (m.room != '' AND m.sender = ? AND NOT m.bot))`
+
+	MAX_MESSAGE_PAGE  = 100
+	MAX_CLIENT_ID_LEN = 64
+)
+
+var (
+	// ErrNoFTS5 is returned for message searches when SQLite was built without FTS5,
+	// or the database was created without the search index.
+	ErrNoFTS5 = errors.New("message search requires FTS5, build with `go build -tags sqlite_fts5` and run `gen-database`")
+	// ErrBadSearch is returned for a search query which is not valid FTS5 syntax.
+	ErrBadSearch = errors.New("invalid search query")
+	// ErrDuplicateMessage is returned when the sender already stored a message with
+	// the same client id.
+	ErrDuplicateMessage = errors.New("duplicate message")
+	// ErrMessageDeleted is returned when changing a message which was deleted.
+	ErrMessageDeleted = errors.New("message was deleted")
+)
+
+// Message is a stored chat message. Room and To are empty for broadcasts.
+type Message struct {
+	Id   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	Room string    `json:"room,omitempty"`
+	To   string    `json:"to,omitempty"`
+	Text string    `json:"text"`
+	// Bot is set for messages posted by an incoming webhook, From is then the name
+	// chosen by the webhook rather than a user.
+	Bot bool `json:"bot,omitempty"`
+	// ClientId is the id assigned by the sending client, unique per sender.
+	ClientId string `json:"client_id,omitempty"`
+	// Delivery is DELIVERY_LIVE or DELIVERY_QUEUED for a direct message being sent,
+	// depending on whether the recipient was connected. It is not stored.
+	Delivery string     `json:"delivery,omitempty"`
+	Edited   *time.Time `json:"edited,omitempty"`
+	// Deleted is set for tombstones of deleted messages, which have no text.
+	Deleted   *time.Time `json:"deleted,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	// Reactions counts the users who reacted with each emoji.
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// ParentId is the root message of the thread of a reply, and Replies counts the
+	// replies to a root message.
+	ParentId int64 `json:"parent_id,omitempty"`
+	Replies  int   `json:"replies,omitempty"`
+}
+
+// MessageFilter selects the messages visible to Viewer, other zero values match
+// everything. Results are newest first and BeforeId pages through older messages.
+type MessageFilter struct {
+	Viewer string
+	Room   string
+	// From selects messages sent by this user. Bot messages never match, a bot may
+	// be given any name.
+	From string
+	// With selects direct messages between Viewer and this user.
+	With string
+	// Parent selects the replies in the thread of this message.
+	Parent   int64
+	Since    time.Time
+	Until    time.Time
+	Query    string
+	BeforeId int64
+	Limit    int
+}
+
+// Thread is a root message with a page of its replies, newest first. NextBefore is set
+// when older replies may exist.
+type Thread struct {
+	Parent     Message   `json:"parent"`
+	Replies    []Message `json:"replies"`
+	NextBefore int64     `json:"next_before,omitempty"`
+}
+
+func checkFTS5(db *sql.DB) error {
+	var ok bool
+	if err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoFTS5
+	}
+	return nil
+}
+
+// CheckFTS5 returns ErrNoFTS5 if message search is unavailable.
+func (d *Database) CheckFTS5() error {
+	if !d.search {
+		return ErrNoFTS5
+	}
+	return nil
+}
+
+// CreateMessage stores a message, setting its id and time, and counts it as a reply
+// to its parent. It returns ErrDuplicateMessage if the sender already stored a message
+// with its ClientId.
+func (d *Database) CreateMessage(m *Message) error {
+	defer d.observe("create_message", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = createMessage(tx, m); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// createMessage must run in a transaction, since it updates the reply count of the
+// parent.
+func createMessage(tx execer, m *Message) error {
+	m.Time = time.Now().Truncate(time.Second)
+	var parent sql.NullInt64
+	if m.ParentId != 0 {
+		parent = sql.NullInt64{Int64: m.ParentId, Valid: true}
+	}
+	res, err := tx.Exec(CREATE_MESSAGE_STMT, m.Time.Unix(), m.From, m.Room, m.To, m.Text, m.Bot, m.ClientId, parent)
+	var e sqlite3.Error
+	if errors.As(err, &e) && e.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrDuplicateMessage
+	}
+	if err != nil {
+		return err
+	}
+	if m.Id, err = res.LastInsertId(); err != nil {
+		return err
+	}
+
+	if m.ParentId != 0 {
+		_, err = tx.Exec(`UPDATE messages SET replies = replies + 1 WHERE id = ?`, m.ParentId)
+	}
+	return err
+}
+
+// FindClientMessage returns the message `sender` stored with the client id, or nil if
+// there is none.
+func (d *Database) FindClientMessage(sender string, clientId string) (*Message, error) {
+	defer d.observe("find_client_message", time.Now())
+
+	m, err := scanMessage(d.db.QueryRow(
+		`SELECT `+MESSAGE_COLUMNS+` FROM messages m WHERE m.sender = ? AND m.client_id = ? AND NOT m.bot`,
+		sender, clientId,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// GetMessages returns the messages matching the filter, newest first.
+func (d *Database) GetMessages(f MessageFilter) ([]Message, error) {
+	defer d.observe("get_messages", time.Now())
+
+	if f.Limit <= 0 || f.Limit > MAX_MESSAGE_PAGE {
+		f.Limit = MAX_MESSAGE_PAGE
+	}
+	if f.Query != "" && !d.search {
+		return nil, ErrNoFTS5
+	}
+
+	conds := []string{VISIBLE_MESSAGE_COND}
+	args := []any{f.Viewer, f.Viewer, f.Viewer, f.Viewer}
+	add := func(cond string, arg ...any) {
+		conds = append(conds, cond)
+		args = append(args, arg...)
+	}
+	if f.Room != "" {
+		add("m.room = ?", f.Room)
+	}
+	if f.From != "" {
+		add("m.sender = ? AND NOT m.bot", f.From)
+	}
+	if f.With != "" {
+		add("((m.sender = ? AND m.recipient = ?) OR (m.sender = ? AND m.recipient = ?))", f.Viewer, f.With, f.With, f.Viewer)
+	}
+	if !f.Since.IsZero() {
+		add("m.time >= ?", f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		add("m.time < ?", f.Until.Unix())
+	}
+	if f.Query != "" {
+		add("m.id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)", f.Query)
+	}
+	if f.Parent != 0 {
+		add("m.parent_id = ?", f.Parent)
+	}
+	if f.BeforeId > 0 {
+		add("m.id < ?", f.BeforeId)
+	}
+
+	query := `SELECT ` + MESSAGE_COLUMNS + ` FROM messages m WHERE ` +
+		strings.Join(conds, " AND ") + ` ORDER BY m.id DESC LIMIT ?`
+	rows, err := d.db.Query(query, append(args, f.Limit)...)
+	if err != nil {
+		return nil, searchErr(f, err)
+	}
+	defer rows.Close()
+
+	var page []*Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, m)
+	}
+	if err := searchErr(f, rows.Err()); err != nil {
+		return nil, err
+	}
+	if err := d.loadReactions(page); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(page))
+	for _, m := range page {
+		messages = append(messages, *m)
+	}
+	return messages, nil
+}
+
+// scanMessage reads a row of MESSAGE_COLUMNS from a *sql.Row or *sql.Rows.
+func scanMessage(row interface{ Scan(...any) error }) (*Message, error) {
+	var m Message
+	var ts int64
+	var edited, deleted, parent sql.NullInt64
+	err := row.Scan(
+		&m.Id, &ts, &m.From, &m.Room, &m.To, &m.Text, &m.Bot, &m.ClientId, &edited, &deleted, &m.DeletedBy,
+		&parent, &m.Replies,
+	)
+	if err != nil {
+		return nil, err
+	}
+	m.ParentId = parent.Int64
+	m.Time = time.Unix(ts, 0)
+	m.Edited = unixTime(edited)
+	m.Deleted = unixTime(deleted)
+	return &m, nil
+}
+
+// unixTime converts a nullable column of unix seconds.
+func unixTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0)
+	return &t
+}
+
+// searchErr maps FTS5 query syntax errors, which SQLite reports as a generic error
+// when the statement is stepped, to ErrBadSearch.
+func searchErr(f MessageFilter, err error) error {
+	var e sqlite3.Error
+	if f.Query != "" && errors.As(err, &e) && e.Code == sqlite3.ErrError {
+		return fmt.Errorf("%w: %s", ErrBadSearch, strings.TrimPrefix(e.Error(), "fts5: "))
+	}
+	return err
+}
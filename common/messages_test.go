@@ -0,0 +1,80 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	d, err := NewDatabase(filepath.Join(t.TempDir(), "db.sqlite"), os.DirFS(".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestVisibleMessages(t *testing.T) {
+	d := newTestDatabase(t)
+
+	// carol was a member of #dev from 200 to 300, times are unix seconds
+	for _, user := range []string{"alice", "carol"} {
+		if _, err := d.JoinRoom("dev", user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.LeaveRoom("dev", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec(`UPDATE room_members SET joined = 200, left = 300 WHERE username = 'carol'`); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []struct {
+		m       Message
+		time    int64
+		visible bool
+	}{
+		{Message{From: "alice", Text: "broadcast"}, 100, true},
+		{Message{From: "alice", To: "carol", Text: "to carol"}, 100, true},
+		{Message{From: "carol", To: "bob", Text: "from carol"}, 100, true},
+		{Message{From: "alice", To: "bob", Text: "between others"}, 100, false},
+		{Message{From: "alice", Room: "dev", Text: "before joining"}, 199, false},
+		{Message{From: "alice", Room: "dev", Text: "on joining"}, 200, true},
+		{Message{From: "alice", Room: "dev", Text: "while a member"}, 250, true},
+		{Message{From: "alice", Room: "dev", Text: "on leaving"}, 300, true},
+		{Message{From: "alice", Room: "dev", Text: "after leaving"}, 301, false},
+		{Message{From: "carol", Room: "ops", Text: "own message"}, 400, true},
+		{Message{From: "carol", Room: "ops", Text: "bot named carol", Bot: true}, 400, false},
+	}
+	var want []string
+	for _, tt := range messages {
+		m := tt.m
+		if err := d.CreateMessage(&m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.db.Exec(`UPDATE messages SET time = ? WHERE id = ?`, tt.time, m.Id); err != nil {
+			t.Fatal(err)
+		}
+		if tt.visible {
+			want = append(want, m.Text)
+		}
+	}
+
+	history, err := d.GetMessages(MessageFilter{Viewer: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range history {
+		got = append(got, m.Text)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("carol can read %q, want %q", got, want)
+	}
+}
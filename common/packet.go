@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -14,6 +15,61 @@ import (
 
 var ErrDisconnected = errors.New("disconnected")
 
+const (
+	PACKET_HEARTBEAT = "heartbeat"
+	PACKET_TEXT      = "text"
+	// PACKET_NOTICE carries a plain text message from the server
+	PACKET_NOTICE = "notice"
+	// PACKET_COMMAND carries a JSON encoded Command
+	PACKET_COMMAND = "command"
+	// PACKET_EVENT carries a JSON encoded Event from the server
+	PACKET_EVENT = "event"
+	// PACKET_JOIN and PACKET_LEAVE carry a room name
+	PACKET_JOIN  = "join"
+	PACKET_LEAVE = "leave"
+	// PACKET_STATUS carries a JSON encoded StatusUpdate
+	PACKET_STATUS = "status"
+	// PACKET_WHO requests the connected users, the server replies with a PACKET_WHO
+	// carrying a JSON encoded []Presence
+	PACKET_WHO = "who"
+	// PACKET_TYPING, PACKET_TYPING_STOP and PACKET_READ are ephemeral signals carrying
+	// a JSON encoded Signal. They are relayed to connected peers and never stored.
+	PACKET_TYPING      = "typing"
+	PACKET_TYPING_STOP = "typing_stop"
+	PACKET_READ        = "read"
+	// PACKET_ACK carries a JSON encoded Ack from the server
+	PACKET_ACK = "ack"
+	// PACKET_EDIT, PACKET_DELETE and PACKET_REACT change a stored message, and carry
+	// a JSON encoded Edit, Delete and Reaction
+	PACKET_EDIT   = "edit"
+	PACKET_DELETE = "delete"
+	PACKET_REACT  = "react"
+	// PACKET_THREAD requests the thread of the message id in its payload, the server
+	// replies with a PACKET_THREAD carrying a JSON encoded Thread
+	PACKET_THREAD = "thread"
+)
+
+// Command is the payload of a PACKET_COMMAND packet.
+type Command struct {
+	Action   string `json:"action"`
+	Target   string `json:"target"`
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Ack is the payload of a PACKET_ACK packet, sent once the Text with the client
+// assigned Id is stored. Error is set instead when the message was rejected, and it
+// should not be sent again.
+type Ack struct {
+	Id        string `json:"id"`
+	MessageId int64  `json:"message_id,omitempty"`
+	// Duplicate is set when the message was stored before, and not delivered again.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Delivery is set for direct messages, see Message.Delivery.
+	Delivery string `json:"delivery,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 type Packet interface {
 	EncodePacket() []byte
 }
@@ -32,6 +88,21 @@ func (p *RawPacket) EncodePacket() []byte {
 	return data
 }
 
+// NewJSONPacket creates a packet with `v` encoded as a JSON payload.
+func NewJSONPacket(ty string, v any) *RawPacket {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return &RawPacket{Type: ty, Payload: data}
+}
+
+// Decode unmarshals a JSON payload into `v`.
+func (p *RawPacket) Decode(v any) error {
+	return json.Unmarshal(p.Payload, v)
+}
+
 func (p *RawPacket) String() string {
 	t := reflect.TypeOf(*p)
 	v := reflect.ValueOf(*p)
@@ -54,6 +125,8 @@ type PacketReadWriter interface {
 	RemoteAddr() net.Addr
 }
 
+// ReadPacket reads the next packet. Errors reading from the connection wrap
+// ErrDisconnected.
 func ReadPacket(conn PacketReadWriter) (*RawPacket, error) {
 	ty, data, err := conn.ReadMessage()
 	if err != nil {
@@ -65,8 +138,8 @@ func ReadPacket(conn PacketReadWriter) (*RawPacket, error) {
 			log.Warnf("unexpected closure: %v", err)
 		}
 
-		log.Infof("disconnected from %v", conn.RemoteAddr().String())
-		return nil, ErrDisconnected
+		log.Info("disconnected", "remote", conn.RemoteAddr().String())
+		return nil, fmt.Errorf("%w: %w", ErrDisconnected, err)
 	}
 
 	var packet RawPacket
@@ -74,7 +147,8 @@ func ReadPacket(conn PacketReadWriter) (*RawPacket, error) {
 		return nil, err
 	}
 
-	log.Infof("recv: addr=%v, type=%v, data=%v", conn.RemoteAddr().String(), ty, packet.String())
+	// payloads may contain private messages and are never logged
+	log.Debug("recv", "remote", conn.RemoteAddr().String(), "msg_type", ty, "type", packet.Type, "bytes", len(packet.Payload))
 	return &packet, nil
 }
 
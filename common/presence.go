@@ -0,0 +1,96 @@
+package common
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	PRESENCE_ONLINE  = "online"
+	PRESENCE_AWAY    = "away"
+	PRESENCE_OFFLINE = "offline"
+
+	MAX_STATUS_LEN = 128
+)
+
+// Presence is the availability of a user. LastSeen is the last activity of a connected
+// user, or when they disconnected, and nil for users who never connected.
+type Presence struct {
+	User     string     `json:"user"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Sessions int        `json:"sessions"`
+}
+
+// StatusUpdate is the payload of a PACKET_STATUS packet. Status may be PRESENCE_AWAY or
+// PRESENCE_ONLINE, and is unchanged when empty. Message replaces the status message
+// when set, an empty string clears it.
+type StatusUpdate struct {
+	Status  string  `json:"status,omitempty"`
+	Message *string `json:"message,omitempty"`
+}
+
+// GetPresence returns the stored presence of every user, who are all offline.
+func (d *Database) GetPresence() ([]Presence, error) {
+	defer d.observe("get_presence", time.Now())
+
+	rows, err := d.db.Query(
+		`SELECT u.username, COALESCE(p.message, ''), p.last_seen FROM users u
+		LEFT JOIN presence p ON p.username = u.username ORDER BY u.username`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []Presence{}
+	for rows.Next() {
+		p := Presence{Status: PRESENCE_OFFLINE}
+		var seen sql.NullInt64
+		if err = rows.Scan(&p.User, &p.Message, &seen); err != nil {
+			return nil, err
+		}
+		if seen.Valid {
+			t := time.Unix(seen.Int64, 0)
+			p.LastSeen = &t
+		}
+		users = append(users, p)
+	}
+
+	return users, rows.Err()
+}
+
+// StatusMessage returns the stored status message of a user.
+func (d *Database) StatusMessage(user string) (string, error) {
+	defer d.observe("status_message", time.Now())
+
+	var msg string
+	err := d.db.QueryRow(`SELECT message FROM presence WHERE username = ?`, user).Scan(&msg)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return msg, err
+}
+
+func (d *Database) SetStatusMessage(user string, msg string) error {
+	defer d.observe("set_status_message", time.Now())
+
+	_, err := d.db.Exec(
+		`INSERT INTO presence (username, message) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET message = excluded.message`,
+		user, msg,
+	)
+	return err
+}
+
+func (d *Database) SetLastSeen(user string, t time.Time) error {
+	defer d.observe("set_last_seen", time.Now())
+
+	_, err := d.db.Exec(
+		`INSERT INTO presence (username, last_seen) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET last_seen = excluded.last_seen`,
+		user, t.Unix(),
+	)
+	return err
+}
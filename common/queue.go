@@ -0,0 +1,158 @@
+package common
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Delivery of a direct message when it is sent.
+const (
+	DELIVERY_LIVE   = "live"
+	DELIVERY_QUEUED = "queued"
+)
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// CreateQueuedMessage stores a direct message and queues it for its offline recipient
+// until `expires`. Like CreateMessage it returns ErrDuplicateMessage for a repeated
+// ClientId.
+func (d *Database) CreateQueuedMessage(m *Message, expires time.Time) error {
+	defer d.observe("create_queued_message", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = createMessage(tx, m); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO offline_queue (message_id, recipient, expires) VALUES (?, ?, ?)`,
+		m.Id, m.To, expires.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CountQueued returns the number of unexpired messages queued for a user.
+func (d *Database) CountQueued(recipient string) (int, error) {
+	defer d.observe("count_queued", time.Now())
+
+	var n int
+	err := d.db.QueryRow(
+		`SELECT COUNT(*) FROM offline_queue WHERE recipient = ? AND expires > ?`,
+		recipient, time.Now().Unix(),
+	).Scan(&n)
+	return n, err
+}
+
+// ClaimQueued removes the unexpired messages queued for a user and returns them, oldest
+// first. Each queued message is claimed once, even when sessions connect at the same
+// time.
+func (d *Database) ClaimQueued(recipient string) ([]Message, error) {
+	defer d.observe("claim_queued", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`DELETE FROM offline_queue WHERE recipient = ? AND expires > ? RETURNING message_id`,
+		recipient, time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	if len(ids) > 0 {
+		placeholders := strings.Repeat("?, ", len(ids)-1) + "?"
+		rows, err = tx.Query(
+			`SELECT `+MESSAGE_COLUMNS+` FROM messages m WHERE m.id IN (`+placeholders+`) AND m.deleted IS NULL ORDER BY m.id`,
+			ids...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			m, err := scanMessage(rows)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, *m)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, tx.Commit()
+}
+
+// UnqueueMessage removes a message from the queue, once it was delivered live.
+func (d *Database) UnqueueMessage(id int64) error {
+	defer d.observe("unqueue_message", time.Now())
+
+	_, err := d.db.Exec(`DELETE FROM offline_queue WHERE message_id = ?`, id)
+	return err
+}
+
+// RequeueMessages queues claimed messages again until `expires`, when they could not
+// be delivered.
+func (d *Database) RequeueMessages(recipient string, messages []Message, expires time.Time) error {
+	defer d.observe("requeue_messages", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range messages {
+		_, err = tx.Exec(
+			`INSERT INTO offline_queue (message_id, recipient, expires) VALUES (?, ?, ?)`,
+			m.Id, recipient, expires.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PruneQueue removes expired queued messages, which stay in the message history.
+func (d *Database) PruneQueue() (int64, error) {
+	defer d.observe("prune_queue", time.Now())
+
+	res, err := d.db.Exec(`DELETE FROM offline_queue WHERE expires <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Fingerprint identifies a secret without revealing any part of it, so log lines and
+// audit entries about the same secret can be correlated.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// RedactHeader hides the credentials in an Authorization header value, keeping the
+// scheme (e.g. `Bearer [REDACTED]`).
+func RedactHeader(value string) string {
+	if value == "" {
+		return ""
+	}
+	scheme, _, ok := strings.Cut(value, " ")
+	if !ok {
+		return redacted
+	}
+	return scheme + " " + redacted
+}
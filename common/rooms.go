@@ -0,0 +1,58 @@
+package common
+
+import "time"
+
+// JoinRoom adds the user to a room, returning false if they were already a member.
+func (d *Database) JoinRoom(room string, user string) (bool, error) {
+	defer d.observe("join_room", time.Now())
+
+	res, err := d.db.Exec(
+		`INSERT OR IGNORE INTO room_members (room, username, joined) VALUES (?, ?, ?)`,
+		room, user, time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// LeaveRoom ends the user's membership of a room, returning false if they were not a
+// member.
+func (d *Database) LeaveRoom(room string, user string) (bool, error) {
+	defer d.observe("leave_room", time.Now())
+
+	res, err := d.db.Exec(
+		`UPDATE room_members SET left = ? WHERE room = ? AND username = ? AND left IS NULL`,
+		time.Now().Unix(), room, user,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// GetRoomMembers returns the current members of every room.
+func (d *Database) GetRoomMembers() (map[string][]string, error) {
+	defer d.observe("get_room_members", time.Now())
+
+	rows, err := d.db.Query(`SELECT room, username FROM room_members WHERE left IS NULL ORDER BY room, username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string][]string)
+	for rows.Next() {
+		var room, user string
+		if err := rows.Scan(&room, &user); err != nil {
+			return nil, err
+		}
+		rooms[room] = append(rooms[room], user)
+	}
+
+	return rooms, rows.Err()
+}
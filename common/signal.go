@@ -0,0 +1,17 @@
+package common
+
+// Signal is the payload of the ephemeral PACKET_TYPING, PACKET_TYPING_STOP and
+// PACKET_READ packets. Clients set either Room or To, and the server sets User before
+// relaying it.
+type Signal struct {
+	User string `json:"user,omitempty"`
+	Room string `json:"room,omitempty"`
+	To   string `json:"to,omitempty"`
+	// MessageId is the last message the user read, for PACKET_READ.
+	MessageId int64 `json:"message_id,omitempty"`
+}
+
+// IsSignal reports whether a packet type is an ephemeral signal.
+func IsSignal(ty string) bool {
+	return ty == PACKET_TYPING || ty == PACKET_TYPING_STOP || ty == PACKET_READ
+}
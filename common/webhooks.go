@@ -0,0 +1,320 @@
+package common
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Events which can be delivered to webhooks.
+const (
+	HOOK_REGISTER   = "user.register"
+	HOOK_CONNECT    = "user.connect"
+	HOOK_DISCONNECT = "user.disconnect"
+	HOOK_MESSAGE    = "message"
+
+	CREATE_WEBHOOK_STMT  = `INSERT INTO webhooks (url, secret, events, room, sender, contains, created_by, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	LOG_DELIVERY_STMT    = `INSERT INTO webhook_deliveries (webhook_id, delivery, event, attempt, time, status, error, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	DEAD_LETTER_STMT     = `INSERT INTO webhook_dead_letters (webhook_id, delivery, event, payload, attempts, error, time) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	CREATE_INCOMING_STMT = `INSERT INTO incoming_webhooks (token, room, username, created_by, created) VALUES (?, ?, ?, ?, ?)`
+	INCOMING_COLUMNS     = `id, token, room, username, created_by, created`
+
+	webhookPageSize = 100
+)
+
+var HookEvents = []string{HOOK_REGISTER, HOOK_CONNECT, HOOK_DISCONNECT, HOOK_MESSAGE}
+
+// Webhook is an outbound webhook. Room, From and Contains only apply to message
+// events, and match every message when empty.
+type Webhook struct {
+	Id     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+	Room   string   `json:"room,omitempty"`
+	From   string   `json:"from,omitempty"`
+	// Contains matches messages containing the text, ignoring case.
+	Contains  string    `json:"contains,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+// Wants reports whether the webhook subscribes to the event. `m` is the message for
+// message events and nil otherwise.
+func (h *Webhook) Wants(event string, m *Message) bool {
+	if !slices.Contains(h.Events, event) {
+		return false
+	}
+	if m == nil {
+		return true
+	}
+
+	return (h.Room == "" || h.Room == m.Room) &&
+		(h.From == "" || h.From == m.From) &&
+		(h.Contains == "" || strings.Contains(strings.ToLower(m.Text), strings.ToLower(h.Contains)))
+}
+
+// WebhookDelivery is a single attempt to deliver an event. Delivery is shared by
+// every attempt of the same payload, and Status is 0 when no response was received.
+type WebhookDelivery struct {
+	Id         int64     `json:"id"`
+	WebhookId  int64     `json:"webhook_id"`
+	Delivery   string    `json:"delivery"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// DeadLetter is a payload which could not be delivered after every attempt.
+type DeadLetter struct {
+	Id        int64     `json:"id"`
+	WebhookId int64     `json:"webhook_id"`
+	Delivery  string    `json:"delivery"`
+	Event     string    `json:"event"`
+	Payload   string    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// IncomingWebhook lets external systems post messages to Room by presenting Token.
+// Username is the bot sender used when a payload does not name one.
+type IncomingWebhook struct {
+	Id        int64     `json:"id"`
+	Token     string    `json:"token,omitempty"`
+	Room      string    `json:"room"`
+	Username  string    `json:"username"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+func (d *Database) CreateWebhook(h *Webhook) error {
+	defer d.observe("create_webhook", time.Now())
+
+	h.Created = time.Now().Truncate(time.Second)
+	res, err := d.db.Exec(
+		CREATE_WEBHOOK_STMT,
+		h.URL, h.Secret, strings.Join(h.Events, ","), h.Room, h.From, h.Contains, h.CreatedBy, h.Created.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	h.Id, err = res.LastInsertId()
+
+	return err
+}
+
+// GetWebhooks returns every webhook including its secret.
+func (d *Database) GetWebhooks() ([]Webhook, error) {
+	defer d.observe("get_webhooks", time.Now())
+
+	rows, err := d.db.Query(`SELECT id, url, secret, events, room, sender, contains, created_by, created FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		var events string
+		var created int64
+		err = rows.Scan(&h.Id, &h.URL, &h.Secret, &events, &h.Room, &h.From, &h.Contains, &h.CreatedBy, &created)
+		if err != nil {
+			return nil, err
+		}
+		h.Events = strings.Split(events, ",")
+		h.Created = time.Unix(created, 0)
+		hooks = append(hooks, h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook with its delivery log and dead letters, returning
+// false if it did not exist.
+func (d *Database) DeleteWebhook(id int64) (bool, error) {
+	defer d.observe("delete_webhook", time.Now())
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM webhook_dead_letters WHERE webhook_id = ?`, id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (d *Database) LogDelivery(w *WebhookDelivery) error {
+	defer d.observe("log_delivery", time.Now())
+
+	res, err := d.db.Exec(
+		LOG_DELIVERY_STMT,
+		w.WebhookId, w.Delivery, w.Event, w.Attempt, w.Time.Unix(), w.Status, w.Error, w.DurationMs,
+	)
+	if err != nil {
+		return err
+	}
+	w.Id, err = res.LastInsertId()
+
+	return err
+}
+
+// GetDeliveries returns the delivery attempts of a webhook, newest first. `beforeId`
+// pages through older attempts when set.
+func (d *Database) GetDeliveries(webhookId int64, beforeId int64, limit int) ([]WebhookDelivery, error) {
+	defer d.observe("get_deliveries", time.Now())
+
+	if limit <= 0 || limit > webhookPageSize {
+		limit = webhookPageSize
+	}
+	if beforeId <= 0 {
+		beforeId = 1<<63 - 1
+	}
+	rows, err := d.db.Query(
+		`SELECT id, webhook_id, delivery, event, attempt, time, status, error, duration_ms FROM webhook_deliveries
+		WHERE webhook_id = ? AND id < ? ORDER BY id DESC LIMIT ?`,
+		webhookId, beforeId, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var w WebhookDelivery
+		var t int64
+		err = rows.Scan(&w.Id, &w.WebhookId, &w.Delivery, &w.Event, &w.Attempt, &t, &w.Status, &w.Error, &w.DurationMs)
+		if err != nil {
+			return nil, err
+		}
+		w.Time = time.Unix(t, 0)
+		deliveries = append(deliveries, w)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (d *Database) DeadLetter(l *DeadLetter) error {
+	defer d.observe("dead_letter", time.Now())
+
+	res, err := d.db.Exec(
+		DEAD_LETTER_STMT,
+		l.WebhookId, l.Delivery, l.Event, l.Payload, l.Attempts, l.Error, l.Time.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	l.Id, err = res.LastInsertId()
+
+	return err
+}
+
+// GetDeadLetters returns the undelivered payloads of a webhook, newest first.
+func (d *Database) GetDeadLetters(webhookId int64) ([]DeadLetter, error) {
+	defer d.observe("get_dead_letters", time.Now())
+
+	rows, err := d.db.Query(
+		`SELECT id, webhook_id, delivery, event, payload, attempts, error, time FROM webhook_dead_letters
+		WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`,
+		webhookId, webhookPageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var l DeadLetter
+		var t int64
+		if err = rows.Scan(&l.Id, &l.WebhookId, &l.Delivery, &l.Event, &l.Payload, &l.Attempts, &l.Error, &t); err != nil {
+			return nil, err
+		}
+		l.Time = time.Unix(t, 0)
+		letters = append(letters, l)
+	}
+
+	return letters, rows.Err()
+}
+
+func (d *Database) CreateIncomingWebhook(h *IncomingWebhook) error {
+	defer d.observe("create_incoming_webhook", time.Now())
+
+	h.Created = time.Now().Truncate(time.Second)
+	res, err := d.db.Exec(CREATE_INCOMING_STMT, h.Token, h.Room, h.Username, h.CreatedBy, h.Created.Unix())
+	if err != nil {
+		return err
+	}
+	h.Id, err = res.LastInsertId()
+
+	return err
+}
+
+// GetIncomingWebhooks returns every incoming webhook including its token.
+func (d *Database) GetIncomingWebhooks() ([]IncomingWebhook, error) {
+	defer d.observe("get_incoming_webhooks", time.Now())
+	return d.queryIncoming(`SELECT ` + INCOMING_COLUMNS + ` FROM incoming_webhooks ORDER BY id`)
+}
+
+// FindIncomingWebhook returns the incoming webhook with the token, or nil if there is
+// none.
+func (d *Database) FindIncomingWebhook(token string) (*IncomingWebhook, error) {
+	defer d.observe("find_incoming_webhook", time.Now())
+
+	hooks, err := d.queryIncoming(`SELECT `+INCOMING_COLUMNS+` FROM incoming_webhooks WHERE token = ? LIMIT 1`, token)
+	return first(hooks), err
+}
+
+// DeleteIncomingWebhook removes an incoming webhook, returning false if it did not
+// exist.
+func (d *Database) DeleteIncomingWebhook(id int64) (bool, error) {
+	defer d.observe("delete_incoming_webhook", time.Now())
+
+	res, err := d.db.Exec(`DELETE FROM incoming_webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+func (d *Database) queryIncoming(query string, args ...any) ([]IncomingWebhook, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []IncomingWebhook{}
+	for rows.Next() {
+		var h IncomingWebhook
+		var created int64
+		if err = rows.Scan(&h.Id, &h.Token, &h.Room, &h.Username, &h.CreatedBy, &created); err != nil {
+			return nil, err
+		}
+		h.Created = time.Unix(created, 0)
+		hooks = append(hooks, h)
+	}
+
+	return hooks, rows.Err()
+}
@@ -8,6 +8,8 @@ import (
 	"hello-go/common"
 	"hello-go/server"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/log"
@@ -36,8 +38,9 @@ func main() {
 		},
 	}
 	app := &cli.App{
-		Name:  "hello-go",
-		Usage: "a basic client-server application",
+		Name:    "hello-go",
+		Usage:   "a basic client-server application",
+		Version: server.Version,
 		Flags: []cli.Flag{
 			&cli.UintFlag{
 				Name:  "port",
@@ -50,14 +53,157 @@ func main() {
 				},
 				Usage: "`PORT` to serve or connect on",
 			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "minimum `LEVEL` to log (debug, info, warn, error, fatal)",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Value: "text",
+				Usage: "log `FORMAT` (text, json, logfmt)",
+			},
+			&cli.PathFlag{
+				Name:  "log-file",
+				Usage: "append logs to `FILE` instead of stderr",
+			},
+		},
+		Before: func(ctx *cli.Context) error {
+			return configureLogging(
+				ctx.String("log-level"),
+				ctx.String("log-format"),
+				ctx.Path("log-file"),
+			)
 		},
 		Commands: []*cli.Command{
 			{
 				Name:    "server",
 				Usage:   "Start a server",
 				Aliases: []string{"s"},
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "listen",
+						Usage: "`ADDR` to listen on (`host:port` or `unix:/path`), may be repeated (default: \":PORT\")",
+					},
+					&cli.StringSliceFlag{
+						Name:  "admin-listen",
+						Usage: "`ADDR` serving the management API, pprof and metrics, may be repeated",
+					},
+					&cli.PathFlag{
+						Name:  "tls-cert",
+						Usage: "`FILE` containing the PEM encoded server certificate",
+					},
+					&cli.PathFlag{
+						Name:  "tls-key",
+						Usage: "`FILE` containing the PEM encoded server private key",
+					},
+					&cli.PathFlag{
+						Name:  "client-ca",
+						Usage: "authenticate clients with certificates signed by the CA in `FILE`",
+					},
+					&cli.UintFlag{
+						Name:  "redirect-port",
+						Usage: "redirect plain HTTP requests on `PORT` to HTTPS (requires TLS)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "allow-origin",
+						Usage: "`ORIGIN` allowed to open a websocket or call the API, may contain `*` wildcards",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-all-origins",
+						Usage: "allow websockets and API requests from any origin (development only)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cors-method",
+						Usage: "`METHOD` allowed in cross-origin API requests (default: GET, POST, PUT, DELETE)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cors-header",
+						Usage: "request `HEADER` allowed in cross-origin API requests (default: Authorization, Content-Type, X-Request-ID)",
+					},
+					&cli.BoolFlag{
+						Name:  "cors-credentials",
+						Usage: "allow cross-origin API requests with cookies or HTTP auth",
+					},
+					&cli.DurationFlag{
+						Name:  "cors-max-age",
+						Usage: "how long browsers may cache CORS preflight responses",
+						Value: 10 * time.Minute,
+					},
+					&cli.DurationFlag{
+						Name:  "audit-retention",
+						Usage: "delete audit log entries older than `DURATION` (e.g. 2160h), keeps all when unset",
+					},
+					&cli.DurationFlag{
+						Name:  "away-after",
+						Usage: "show users as away once every session has been idle for `DURATION`",
+						Value: 5 * time.Minute,
+					},
+					&cli.DurationFlag{
+						Name:  "edit-window",
+						Usage: "let authors edit messages for `DURATION` after sending them",
+						Value: 15 * time.Minute,
+					},
+					&cli.IntFlag{
+						Name:  "offline-queue-limit",
+						Usage: "queue at most `N` direct messages for an offline user",
+						Value: 100,
+					},
+					&cli.DurationFlag{
+						Name:  "offline-queue-ttl",
+						Usage: "deliver direct messages queued for an offline user for `DURATION`",
+						Value: 7 * 24 * time.Hour,
+					},
+					&cli.IntFlag{
+						Name:  "webhook-attempts",
+						Usage: "try webhook deliveries `N` times before moving them to the dead-letter table",
+						Value: 5,
+					},
+					&cli.DurationFlag{
+						Name:  "webhook-backoff",
+						Usage: "delay before the first webhook retry, doubled after each attempt",
+						Value: 2 * time.Second,
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					s := server.New(uint16(ctx.Uint("port")))
+					cfg := server.Config{
+						Port:              uint16(ctx.Uint("port")),
+						Listen:            ctx.StringSlice("listen"),
+						AdminListen:       ctx.StringSlice("admin-listen"),
+						TLSCert:           ctx.Path("tls-cert"),
+						TLSKey:            ctx.Path("tls-key"),
+						ClientCA:          ctx.Path("client-ca"),
+						RedirectPort:      uint16(ctx.Uint("redirect-port")),
+						AllowedOrigins:    ctx.StringSlice("allow-origin"),
+						AuditRetention:    ctx.Duration("audit-retention"),
+						CORSMethods:       ctx.StringSlice("cors-method"),
+						CORSHeaders:       ctx.StringSlice("cors-header"),
+						CORSCredentials:   ctx.Bool("cors-credentials"),
+						CORSMaxAge:        ctx.Duration("cors-max-age"),
+						WebhookAttempts:   ctx.Int("webhook-attempts"),
+						WebhookBackoff:    ctx.Duration("webhook-backoff"),
+						AwayAfter:         ctx.Duration("away-after"),
+						OfflineQueueLimit: ctx.Int("offline-queue-limit"),
+						OfflineQueueTTL:   ctx.Duration("offline-queue-ttl"),
+						EditWindow:        ctx.Duration("edit-window"),
+					}
+					if ctx.Bool("allow-all-origins") {
+						cfg.AllowedOrigins = []string{"*"}
+					}
+					if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+						return errors.New("--tls-cert and --tls-key must be used together")
+					}
+					if cfg.ClientCA != "" && !cfg.UseTLS() {
+						return errors.New("--client-ca requires --tls-cert and --tls-key")
+					}
+					if cfg.RedirectPort != 0 && !cfg.UseTLS() {
+						return errors.New("--redirect-port requires --tls-cert and --tls-key")
+					}
+
+					s, err := server.New(cfg)
+					if err != nil {
+						return err
+					}
 					log.Fatal(s.Run())
 					return nil
 				},
@@ -66,13 +212,50 @@ func main() {
 				Name:    "client",
 				Usage:   "Start a client",
 				Aliases: []string{"c"},
-				Flags:   userPassFlags,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "host",
+						Value: "localhost",
+						Usage: "`HOST` name or IP address of the server",
+					},
+					&cli.StringFlag{
+						Name:  "url",
+						Usage: "server base `URL` (e.g. https://[::1]:3000), overrides --host and --port",
+					},
+					&cli.BoolFlag{
+						Name:  "tls",
+						Usage: "connect with https and wss",
+					},
+					&cli.PathFlag{
+						Name:  "ca",
+						Usage: "`FILE` with CA certificates to trust (implies --tls)",
+					},
+					&cli.PathFlag{
+						Name:  "cert",
+						Usage: "`FILE` with a client certificate to authenticate with (implies --tls)",
+					},
+					&cli.PathFlag{
+						Name:  "key",
+						Usage: "`FILE` with the private key for --cert",
+					},
+				}, userPassFlags...),
 				Action: func(ctx *cli.Context) error {
 					user := ctx.String("username")
 					if user == "" {
 						user = "guest"
 					}
-					c := client.New(uint16(ctx.Uint("port")))
+					c, err := client.New(client.Config{
+						Host: ctx.String("host"),
+						Port: uint16(ctx.Uint("port")),
+						URL:  ctx.String("url"),
+						TLS:  ctx.Bool("tls"),
+						CA:   ctx.Path("ca"),
+						Cert: ctx.Path("cert"),
+						Key:  ctx.Path("key"),
+					})
+					if err != nil {
+						return err
+					}
 					c.Run(user, ctx.String("password"))
 					return nil
 				},
@@ -84,11 +267,8 @@ func main() {
 				Aliases: []string{"r"},
 				Action: func(ctx *cli.Context) error {
 					user := ctx.String("username")
-					if user == "" {
-						return errors.New("username must not be empty")
-					}
-					if user == "guest" {
-						return errors.New("`guest` is a reserved name and cannot be used")
+					if err := common.ValidateUsername(user); err != nil {
+						return err
 					}
 
 					pass := ctx.String("password")
@@ -97,7 +277,81 @@ func main() {
 					}
 
 					db := common.DbConnect()
-					return db.CreateUser(user, pass)
+					defer db.Close()
+					if err := db.CreateUser(user, pass); err != nil {
+						return err
+					}
+					db.Audit(common.AuditEntry{
+						Action: common.AUDIT_USER_CREATE,
+						Actor:  "cli",
+						Target: user,
+					})
+					return nil
+				},
+			},
+			{
+				Name:      "set-role",
+				Usage:     "Change the role of a user (user, admin)",
+				ArgsUsage: "USERNAME ROLE",
+				Action: func(ctx *cli.Context) error {
+					user, role := ctx.Args().Get(0), ctx.Args().Get(1)
+					if user == "" || role == "" {
+						return errors.New("usage: set-role USERNAME ROLE")
+					}
+
+					db := common.DbConnect()
+					defer db.Close()
+					info, err := db.UserInfo(user)
+					if err != nil {
+						return err
+					}
+					if info == nil {
+						return fmt.Errorf("user `%s` does not exist", user)
+					}
+					if _, err = db.SetRole(user, role); err != nil {
+						return err
+					}
+					db.Audit(common.AuditEntry{
+						Action: common.AUDIT_ROLE_CHANGE,
+						Actor:  "cli",
+						Target: user,
+						Detail: info.Role + " -> " + role,
+					})
+					return nil
+				},
+			},
+			{
+				Name:  "audit-export",
+				Usage: "Export the audit log as JSON lines",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:  "out",
+						Usage: "write to `FILE` instead of stdout",
+					},
+					&cli.DurationFlag{
+						Name:  "since",
+						Usage: "only export entries newer than `DURATION` ago",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					out := os.Stdout
+					if path := ctx.Path("out"); path != "" {
+						f, err := os.Create(path)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						out = f
+					}
+
+					var filter common.AuditFilter
+					if d := ctx.Duration("since"); d > 0 {
+						filter.Since = time.Now().Add(-d)
+					}
+
+					db := common.DbConnect()
+					defer db.Close()
+					return db.ExportAudit(out, filter)
 				},
 			},
 			{
@@ -109,6 +363,77 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "gen-cert",
+				Usage: "Create a local CA and server certificate for development",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:  "out",
+						Value: "certs",
+						Usage: "`DIR` to write certificates to (an existing CA is reused)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "host",
+						Value: cli.NewStringSlice("localhost", "127.0.0.1", "::1"),
+						Usage: "`HOST` name or IP address the server certificate is valid for",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					dir := ctx.Path("out")
+					ca, err := common.LoadOrGenCA(dir)
+					if err != nil {
+						return err
+					}
+
+					cert, err := ca.IssueServerCert(ctx.StringSlice("host"))
+					if err != nil {
+						return err
+					}
+					return cert.WriteFiles(
+						filepath.Join(dir, common.SERVER_CERT_FILE),
+						filepath.Join(dir, common.SERVER_KEY_FILE),
+					)
+				},
+			},
+			{
+				Name:  "gen-client-cert",
+				Usage: "Issue a client certificate for a user from the local CA",
+				Flags: []cli.Flag{
+					&cli.PathFlag{
+						Name:  "out",
+						Value: "certs",
+						Usage: "`DIR` containing the CA created by gen-cert",
+					},
+					&cli.StringFlag{
+						Name:     "username",
+						Usage:    "`USERNAME` the certificate authenticates as",
+						Aliases:  []string{"u"},
+						Required: true,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					user := ctx.String("username")
+					db := common.DbConnect()
+					defer db.Close()
+					if !db.UserExists(user) {
+						return fmt.Errorf("user `%s` does not exist", user)
+					}
+
+					dir := ctx.Path("out")
+					ca, err := common.LoadCA(dir)
+					if err != nil {
+						return err
+					}
+					cert, err := ca.IssueClientCert(user)
+					if err != nil {
+						return err
+					}
+					return cert.WriteFiles(
+						filepath.Join(dir, user+".pem"),
+						filepath.Join(dir, user+".key"),
+					)
+				},
+			},
 			{
 				Name:    "gen-password",
 				Usage:   "Create salt and hash values for passwords",
@@ -134,6 +459,36 @@ func main() {
 	}
 }
 
+// configureLogging applies the logging flags, replacing the defaults from setupLogging.
+func configureLogging(level string, format string, file string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level `%s`", level)
+	}
+	log.SetLevel(lvl)
+
+	switch format {
+	case "text":
+		log.SetFormatter(log.TextFormatter)
+	case "json":
+		log.SetFormatter(log.JSONFormatter)
+	case "logfmt":
+		log.SetFormatter(log.LogfmtFormatter)
+	default:
+		return fmt.Errorf("invalid log format `%s`", format)
+	}
+
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+
+	return nil
+}
+
 func setupLogging() {
 	log.SetLevel(log.DebugLevel)
 	styles := log.DefaultStyles()
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/charmbracelet/log"
+)
+
+// registerDebug adds the pprof and expvar endpoints to the admin mux. These are never
+// served to chat clients.
+func registerDebug(mux *http.ServeMux) {
+	log.Debug("creating debug routes: `/debug/pprof/`, `/debug/vars` (admin)")
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+}
@@ -1,31 +1,65 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hello-go/common"
 	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/matoous/go-nanoid/v2"
 )
 
-const bearerPrefix = "Bearer "
+const (
+	bearerPrefix = "Bearer "
+	// minWebhookSecret is the shortest webhook secret which may be chosen by an admin.
+	minWebhookSecret = 16
+	// defaultBotName is the sender of incoming webhook messages which do not set one.
+	defaultBotName = "webhook"
+)
 
 type obj map[string]any
 
-func logMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			log.Debugf("api request: %v, sender=%v", r.URL, r.RemoteAddr)
-			next.ServeHTTP(w, r)
-		})
+func (s *WsServer) bearerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.certUser(r)
+		if !ok {
+			user = s.db.TokenUser(getBearerToken(r))
+		}
+		if user == "" {
+			s.metrics.authFailures.Inc("token")
+			writeError(w, r, errUnauthorized("Missing or invalid bearer token"))
+			return
+		}
+		if b := s.checkBan(user, r); b != nil {
+			writeError(w, r, errBanned(b))
+			return
+		}
+
+		info := getRequestInfo(r)
+		if info == nil {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoCtxKey, info))
+		}
+		info.user = user
+
+		next.ServeHTTP(w, r)
+	})
 }
 
-func (s *WsServer) bearerAuth(next http.Handler) http.Handler {
+// requireAdmin rejects users without the admin role, it must be wrapped by bearerAuth.
+func (s *WsServer) requireAdmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := getBearerToken(r)
-		if !s.db.IsValidToken(token) {
-			writeErrorJSON(w, http.StatusUnauthorized)
+		if !s.db.IsAdmin(requestUser(r)) {
+			writeError(w, r, errForbidden("Admin role required"))
 			return
 		}
 
@@ -35,9 +69,10 @@ func (s *WsServer) bearerAuth(next http.Handler) http.Handler {
 
 func (s *WsServer) basicAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || !s.db.AuthUser(user, pass) {
-			writeErrorJSON(w, http.StatusUnauthorized, "Invalid credentials")
+		if user, ok := s.authenticate(r); !ok {
+			s.metrics.authFailures.Inc("password")
+			s.audit(common.AUDIT_LOGIN_FAILED, user, user, r.RemoteAddr, "basic auth")
+			writeError(w, r, errUnauthorized("Invalid credentials"))
 			return
 		}
 
@@ -46,25 +81,48 @@ func (s *WsServer) basicAuth(next http.Handler) http.Handler {
 }
 
 func (s *WsServer) apiCreateToken(w http.ResponseWriter, r *http.Request) {
-	user, pass, ok := r.BasicAuth()
-	if !ok || !s.db.AuthUser(user, pass) {
-		writeErrorJSON(w, http.StatusUnauthorized, "Invalid credentials")
+	user, ok := s.authenticate(r)
+	if !ok {
+		s.metrics.authFailures.Inc("password")
+		s.audit(common.AUDIT_LOGIN_FAILED, user, user, r.RemoteAddr, "token request")
+		writeError(w, r, errUnauthorized("Invalid credentials"))
+		return
+	}
+	if b := s.checkBan(user, r); b != nil {
+		writeError(w, r, errBanned(b))
 		return
 	}
 	token, err := s.db.CreateToken(user)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, r, err)
 		return
 	}
+	s.audit(common.AUDIT_TOKEN_CREATE, user, user, r.RemoteAddr, "token "+common.Fingerprint(token))
 
 	writeJSON(w, http.StatusCreated, obj{"token": token})
 }
 
+func (s *WsServer) apiRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token := getBearerToken(r)
+	user := s.db.TokenUser(token)
+	if user == "" {
+		writeError(w, r, errUnauthorized("Invalid token"))
+		return
+	}
+
+	if _, err := s.db.RevokeToken(token); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_TOKEN_REVOKE, user, user, r.RemoteAddr, "token "+common.Fingerprint(token))
+
+	writeJSON(w, http.StatusOK, obj{"message": "Token revoked"})
+}
+
 func (s *WsServer) apiCheckToken(w http.ResponseWriter, r *http.Request) {
 	token := getBearerToken(r)
 	if !s.db.IsValidToken(token) {
-		writeErrorJSON(w, http.StatusUnauthorized, "Invalid token")
+		writeError(w, r, errUnauthorized("Invalid token"))
 		return
 	}
 
@@ -76,65 +134,580 @@ func (s *WsServer) apiCreateUser(w http.ResponseWriter, r *http.Request) {
 		User string `json:"user"`
 		Pass string `json:"pass"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		writeErrorJSON(w, http.StatusBadRequest, "Missing required fields")
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	c.User = strings.TrimSpace(c.User)
 	c.Pass = strings.TrimSpace(c.Pass)
-	if c.User == "" || c.Pass == "" {
-		writeErrorJSON(
-			w,
-			http.StatusBadRequest,
-			"Username and password must not be empty or whitespace",
-		)
+	var v validation
+	if err := common.ValidateUsername(c.User); err != nil {
+		v.add("user", "%v", err)
+	}
+	v.check(c.Pass != "", "pass", "password must not be empty or whitespace")
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if err := s.db.CreateUser(c.User, c.Pass); err != nil {
-		writeErrorJSON(w, http.StatusBadRequest, "User already exists")
+	err := s.db.CreateUser(c.User, c.Pass)
+	if errors.Is(err, common.ErrUserExists) {
+		writeError(w, r, errConflict("User `%s` already exists", c.User))
 		return
 	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_USER_CREATE, c.User, c.User, r.RemoteAddr, "self-registration")
+	s.webhooks.dispatch(common.HOOK_REGISTER, obj{"user": c.User}, nil)
 
 	writeJSON(w, http.StatusCreated, obj{})
 }
 
 func (s *WsServer) apiStatus(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	clients := len(s.peers)
+	s.RUnlock()
+
+	db := obj{"status": "ok"}
+	start := time.Now()
+	if err := s.db.Ping(); err != nil {
+		db["status"] = "error"
+		db["error"] = err.Error()
+	}
+	db["latency_ms"] = float64(time.Since(start)) / float64(time.Millisecond)
+
 	writeJSON(w, http.StatusOK, obj{
-		"status":  "online",
-		"clients": len(s.peers),
+		"status":     "online",
+		"clients":    clients,
+		"version":    Version,
+		"build":      buildInfo(),
+		"started":    s.started,
+		"uptime":     time.Since(s.started).Round(time.Second).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"database":   db,
+		"listeners":  obj{"public": s.listenAddrs, "admin": s.adminAddrs},
 	})
 }
 
+func (s *WsServer) apiGetConnections(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	conns := make([]PeerInfo, 0, len(s.peers))
+	for p := range s.peers {
+		conns = append(conns, p.Info())
+	}
+	s.RUnlock()
+
+	slices.SortFunc(conns, func(a, b PeerInfo) int {
+		return a.Connected.Compare(b.Connected)
+	})
+	writeJSON(w, http.StatusOK, obj{"connections": conns})
+}
+
+func (s *WsServer) apiGetConnection(w http.ResponseWriter, r *http.Request) {
+	p := s.findPeer(r.PathValue("id"))
+	if p == nil {
+		writeError(w, r, errNotFound("Connection not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p.Info())
+}
+
 func (s *WsServer) apiGetUsers(w http.ResponseWriter, r *http.Request) {
 	users, err := s.db.GetUsers()
 	if err != nil {
-		writeErrorJSON(w, http.StatusInternalServerError, err.Error())
+		writeError(w, r, err)
+		return
 	}
 
 	writeJSON(w, http.StatusOK, obj{"users": users})
 }
 
-// It makes no sense to allow users to see this data, but just for demo purposes
+// apiGetUser returns the stored account of a user, including the password hash, so it
+// requires the admin role.
 func (s *WsServer) apiGetUser(w http.ResponseWriter, r *http.Request) {
-	userId := r.PathValue("userId")
-	if userId == "" {
-		writeErrorJSON(w, http.StatusBadRequest, "missing required `userId` resource")
+	u, err := s.db.UserInfo(r.PathValue("userId"))
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	if u == nil {
+		writeError(w, r, errNotFound("User not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+// apiModerate handles a moderation action whose target is the path value `param`. The
+// optional JSON body may set a `reason` and `duration`.
+func (s *WsServer) apiModerate(action string, param string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := common.Command{Action: action, Target: r.PathValue(param)}
+		if r.ContentLength != 0 {
+			if err := decodeJSON(w, r, &c); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			c.Action, c.Target = action, r.PathValue(param)
+		}
 
-	u, err := s.db.UserInfo(userId)
+		msg, err := s.moderate(requestUser(r), r.RemoteAddr, c)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, obj{"message": msg})
+	})
+}
+
+func (s *WsServer) apiGetBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.db.GetBans()
 	if err != nil {
-		writeErrorJSON(w, http.StatusInternalServerError, "%v", err.Error())
+		writeError(w, r, err)
 		return
 	}
-	if u == nil {
-		writeJSON(w, http.StatusOK, obj{})
+
+	writeJSON(w, http.StatusOK, obj{"bans": bans})
+}
+
+func (s *WsServer) apiCreateBan(w http.ResponseWriter, r *http.Request) {
+	var c struct {
+		Kind     string `json:"kind"`
+		Value    string `json:"value"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, u)
+	var v validation
+	b := &common.Ban{Kind: c.Kind, Value: c.Value, Reason: c.Reason, CreatedBy: requestUser(r)}
+	if c.Duration != "" {
+		d, err := time.ParseDuration(c.Duration)
+		if err != nil || d <= 0 {
+			v.add("duration", "invalid duration `%s`", c.Duration)
+		} else {
+			t := time.Now().Add(d)
+			b.Expires = &t
+		}
+	}
+	switch {
+	case c.Kind != common.BAN_USER && c.Kind != common.BAN_IP:
+		v.add("kind", "kind must be `%s` or `%s`", common.BAN_USER, common.BAN_IP)
+	case c.Value == "":
+		v.add("value", "value must not be empty")
+	default:
+		if err := common.NormalizeBan(b); err != nil {
+			v.add("value", "%v", err)
+		}
+	}
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.ban(b, r.RemoteAddr); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, b)
+}
+
+func (s *WsServer) apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("userId")
+	ok, err := s.db.DeleteUser(user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, r, errNotFound("User not found"))
+		return
+	}
+
+	actor := requestUser(r)
+	s.audit(common.AUDIT_USER_DELETE, actor, user, r.RemoteAddr, "")
+	s.kick(user, "account deleted by "+actor)
+	s.forgetUser(user)
+
+	writeJSON(w, http.StatusOK, obj{"message": "User deleted"})
+}
+
+func (s *WsServer) apiSetRole(w http.ResponseWriter, r *http.Request) {
+	var c struct {
+		Role string `json:"role"`
+	}
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if c.Role != common.ROLE_USER && c.Role != common.ROLE_ADMIN {
+		writeError(w, r, errInvalidField("role", "role must be `%s` or `%s`", common.ROLE_USER, common.ROLE_ADMIN))
+		return
+	}
+
+	user := r.PathValue("userId")
+	info, err := s.db.UserInfo(user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if info == nil {
+		writeError(w, r, errNotFound("User not found"))
+		return
+	}
+	if _, err = s.db.SetRole(user, c.Role); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_ROLE_CHANGE, requestUser(r), user, r.RemoteAddr, info.Role+" -> "+c.Role)
+
+	writeJSON(w, http.StatusOK, obj{"username": user, "role": c.Role})
+}
+
+func (s *WsServer) apiGetAudit(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	entries, err := s.db.GetAudit(f)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, obj{"entries": entries})
+}
+
+func (s *WsServer) apiExportAudit(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	if err = s.db.ExportAudit(w, f); err != nil {
+		log.Error("audit export failed", "err", err)
+	}
+}
+
+func (s *WsServer) apiGetRooms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, obj{"rooms": s.roomList(requestUser(r))})
+}
+
+// apiJoinRoom adds the user to a room, succeeding if they are already a member.
+func (s *WsServer) apiJoinRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := s.joinRoom(requestUser(r), r.PathValue("room"))
+	if err != nil && !hasCode(err, CODE_CONFLICT) {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, obj{"room": room, "joined": true})
+}
+
+func (s *WsServer) apiLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := s.leaveRoom(requestUser(r), r.PathValue("room"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, obj{"room": room, "joined": false})
+}
+
+// apiPostMessage sends a message as the authenticated user, see postText.
+func (s *WsServer) apiPostMessage(w http.ResponseWriter, r *http.Request) {
+	var t common.Text
+	if err := decodeJSON(w, r, &t); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	m, duplicate, err := s.postText(requestUser(r), t)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if duplicate {
+		writeJSON(w, http.StatusOK, m)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// apiGetMessages returns a page of the history visible to the user, newest first.
+// `next_before` is set when older messages may exist.
+func (s *WsServer) apiGetMessages(w http.ResponseWriter, r *http.Request) {
+	f, err := messageFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	messages, err := s.db.GetMessages(f)
+	if errors.Is(err, common.ErrBadSearch) {
+		writeError(w, r, errInvalidField("q", "%v", err))
+		return
+	}
+	if errors.Is(err, common.ErrNoFTS5) {
+		writeError(w, r, newApiError(http.StatusNotImplemented, CODE_NOT_IMPLEMENTED, "%v", err))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	res := obj{"messages": messages}
+	if n := len(messages); n > 0 && n == f.Limit {
+		res["next_before"] = messages[n-1].Id
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// apiGetWebhooks lists the webhooks, secrets are only returned when a webhook is
+// created.
+func (s *WsServer) apiGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.db.GetWebhooks()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	writeJSON(w, http.StatusOK, obj{"webhooks": hooks})
+}
+
+func (s *WsServer) apiCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var h common.Webhook
+	if err := decodeJSON(w, r, &h); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var v validation
+	if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("url", "url must be an absolute http or https URL")
+	}
+	v.check(len(h.Events) > 0, "events", "events must not be empty")
+	for _, e := range h.Events {
+		v.check(slices.Contains(common.HookEvents, e), "events", "unknown event `%s`", e)
+	}
+	if h.Room != "" {
+		room, err := common.NormalizeRoom(h.Room)
+		if err != nil {
+			v.add("room", "%v", err)
+		}
+		h.Room = room
+	}
+	v.check(h.Secret == "" || len(h.Secret) >= minWebhookSecret, "secret", "secret must be at least %d characters", minWebhookSecret)
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if h.Secret == "" {
+		secret, err := gonanoid.New(32)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		h.Secret = secret
+	}
+	slices.Sort(h.Events)
+	h.Events = slices.Compact(h.Events)
+	h.CreatedBy = requestUser(r)
+	if err := s.db.CreateWebhook(&h); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.loadWebhooks(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_WEBHOOK_CREATE, h.CreatedBy, strconv.FormatInt(h.Id, 10), r.RemoteAddr, h.URL)
+
+	writeJSON(w, http.StatusCreated, h)
+}
+
+func (s *WsServer) apiDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	h, err := s.pathWebhook(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err = s.db.DeleteWebhook(h.Id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = s.loadWebhooks(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_WEBHOOK_DELETE, requestUser(r), strconv.FormatInt(h.Id, 10), r.RemoteAddr, h.URL)
+
+	writeJSON(w, http.StatusOK, obj{"message": "Webhook deleted"})
+}
+
+// apiGetDeliveries returns the delivery log of a webhook, newest first. `before` and
+// `limit` page through older attempts.
+func (s *WsServer) apiGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	h, err := s.pathWebhook(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var before int64
+	var limit int
+	q := r.URL.Query()
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, r, errInvalidField("before", "invalid `before` id `%s`", v))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, r, errInvalidField("limit", "invalid `limit` `%s`", v))
+			return
+		}
+	}
+
+	deliveries, err := s.db.GetDeliveries(h.Id, before, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, obj{"deliveries": deliveries})
+}
+
+func (s *WsServer) apiGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	h, err := s.pathWebhook(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	letters, err := s.db.GetDeadLetters(h.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, obj{"dead_letters": letters})
+}
+
+// pathWebhook finds the webhook in the `id` path value.
+func (s *WsServer) pathWebhook(r *http.Request) (common.Webhook, error) {
+	v := r.PathValue("id")
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return common.Webhook{}, errInvalidField("id", "invalid webhook id `%s`", v)
+	}
+	h, ok := s.webhooks.find(id)
+	if !ok {
+		return h, errNotFound("Webhook not found")
+	}
+	return h, nil
+}
+
+// incomingWebhookInfo is the API representation of an incoming webhook, URL is the
+// path external systems post to.
+type incomingWebhookInfo struct {
+	common.IncomingWebhook
+	URL string `json:"url,omitempty"`
+}
+
+// apiGetIncomingWebhooks lists the incoming webhooks, tokens are only returned when a
+// webhook is created.
+func (s *WsServer) apiGetIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.db.GetIncomingWebhooks()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Token = ""
+	}
+
+	writeJSON(w, http.StatusOK, obj{"incoming_webhooks": hooks})
+}
+
+func (s *WsServer) apiCreateIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	var h common.IncomingWebhook
+	if err := decodeJSON(w, r, &h); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var v validation
+	room, err := common.NormalizeRoom(h.Room)
+	if err != nil {
+		v.add("room", "%v", err)
+	}
+	h.Room = room
+	h.Username = strings.TrimSpace(h.Username)
+	if h.Username == "" {
+		h.Username = defaultBotName
+	}
+	if err := validBotName(h.Username); err != nil {
+		v.add("username", "%v", err)
+	}
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if h.Token, err = gonanoid.New(32); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.CreatedBy = requestUser(r)
+	if err := s.db.CreateIncomingWebhook(&h); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.audit(common.AUDIT_INCOMING_CREATE, h.CreatedBy, strconv.FormatInt(h.Id, 10), r.RemoteAddr, "#"+h.Room)
+
+	writeJSON(w, http.StatusCreated, incomingWebhookInfo{h, apiPrefix + "/hooks/" + h.Token})
+}
+
+func (s *WsServer) apiDeleteIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	v := r.PathValue("id")
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		writeError(w, r, errInvalidField("id", "invalid webhook id `%s`", v))
+		return
+	}
+	ok, err := s.db.DeleteIncomingWebhook(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, r, errNotFound("Webhook not found"))
+		return
+	}
+	s.audit(common.AUDIT_INCOMING_DELETE, requestUser(r), v, r.RemoteAddr, "")
+
+	writeJSON(w, http.StatusOK, obj{"message": "Webhook deleted"})
 }
 
 type endpoint struct {
@@ -142,20 +715,62 @@ type endpoint struct {
 	route     string
 	handler   http.Handler
 	protected bool
+	// admin routes are served on the admin mux
+	admin bool
+	// requireAdmin restricts the route to users with the admin role
+	requireAdmin bool
 }
 
-func (s *WsServer) registerApi() {
-	prefix := "/api/v1"
+const apiPrefix = "/api/v1"
 
-	for _, e := range []endpoint{
+// endpoints lists every API route, each must be described in openapi.json.
+func (s *WsServer) endpoints() []endpoint {
+	return []endpoint{
 		{method: "POST", route: "/register", handler: http.HandlerFunc(s.apiCreateUser)},
-		{method: "GET", route: "/status", handler: http.HandlerFunc(s.apiStatus), protected: true},
+		{method: "GET", route: "/status", handler: http.HandlerFunc(s.apiStatus), protected: true, admin: true, requireAdmin: true},
 		{method: "POST", route: "/users/token", handler: http.HandlerFunc(s.apiCreateToken)},
 		{method: "GET", route: "/users/token", handler: http.HandlerFunc(s.apiCheckToken)},
-		{method: "GET", route: "/users", handler: http.HandlerFunc(s.apiGetUsers), protected: true},
-		{method: "GET", route: "/users/{userId}", handler: http.HandlerFunc(s.apiGetUser), protected: true},
-	} {
-		route := prefix + e.route
+		{method: "DELETE", route: "/users/token", handler: http.HandlerFunc(s.apiRevokeToken)},
+		{method: "GET", route: "/users", handler: http.HandlerFunc(s.apiGetUsers), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/users/{userId}", handler: http.HandlerFunc(s.apiGetUser), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/connections", handler: http.HandlerFunc(s.apiGetConnections), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/connections/{id}", handler: http.HandlerFunc(s.apiGetConnection), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/connections/{id}/kick", handler: s.apiModerate(ACTION_KICK, "id"), protected: true, admin: true, requireAdmin: true},
+		{method: "DELETE", route: "/users/{userId}", handler: http.HandlerFunc(s.apiDeleteUser), protected: true, admin: true, requireAdmin: true},
+		{method: "PUT", route: "/users/{userId}/role", handler: http.HandlerFunc(s.apiSetRole), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/users/{userId}/kick", handler: s.apiModerate(ACTION_KICK, "userId"), protected: true, admin: true, requireAdmin: true},
+		{method: "PUT", route: "/users/{userId}/mute", handler: s.apiModerate(ACTION_MUTE, "userId"), protected: true, admin: true, requireAdmin: true},
+		{method: "DELETE", route: "/users/{userId}/mute", handler: s.apiModerate(ACTION_UNMUTE, "userId"), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/bans", handler: http.HandlerFunc(s.apiGetBans), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/bans", handler: http.HandlerFunc(s.apiCreateBan), protected: true, admin: true, requireAdmin: true},
+		{method: "DELETE", route: "/bans/{id}", handler: s.apiModerate(ACTION_UNBAN, "id"), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/audit", handler: http.HandlerFunc(s.apiGetAudit), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/audit/export", handler: http.HandlerFunc(s.apiExportAudit), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/webhooks", handler: http.HandlerFunc(s.apiGetWebhooks), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/webhooks", handler: http.HandlerFunc(s.apiCreateWebhook), protected: true, admin: true, requireAdmin: true},
+		{method: "DELETE", route: "/webhooks/{id}", handler: http.HandlerFunc(s.apiDeleteWebhook), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/webhooks/{id}/deliveries", handler: http.HandlerFunc(s.apiGetDeliveries), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/webhooks/{id}/dead-letters", handler: http.HandlerFunc(s.apiGetDeadLetters), protected: true, admin: true, requireAdmin: true},
+		{method: "GET", route: "/incoming-webhooks", handler: http.HandlerFunc(s.apiGetIncomingWebhooks), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/incoming-webhooks", handler: http.HandlerFunc(s.apiCreateIncomingWebhook), protected: true, admin: true, requireAdmin: true},
+		{method: "DELETE", route: "/incoming-webhooks/{id}", handler: http.HandlerFunc(s.apiDeleteIncomingWebhook), protected: true, admin: true, requireAdmin: true},
+		{method: "POST", route: "/hooks/{token}", handler: http.HandlerFunc(s.apiIncomingWebhook)},
+		{method: "GET", route: "/rooms", handler: http.HandlerFunc(s.apiGetRooms), protected: true},
+		{method: "PUT", route: "/rooms/{room}/membership", handler: http.HandlerFunc(s.apiJoinRoom), protected: true},
+		{method: "DELETE", route: "/rooms/{room}/membership", handler: http.HandlerFunc(s.apiLeaveRoom), protected: true},
+		{method: "GET", route: "/messages", handler: http.HandlerFunc(s.apiGetMessages), protected: true},
+		{method: "POST", route: "/messages", handler: http.HandlerFunc(s.apiPostMessage), protected: true},
+		{method: "GET", route: "/messages/{id}/thread", handler: http.HandlerFunc(s.apiGetThread), protected: true},
+		{method: "GET", route: "/presence", handler: http.HandlerFunc(s.apiGetPresence), protected: true},
+		{method: "GET", route: "/events", handler: http.HandlerFunc(s.apiEvents), protected: true},
+		{method: "GET", route: "/openapi.json", handler: http.HandlerFunc(apiOpenApi)},
+		{method: "GET", route: "/docs", handler: http.HandlerFunc(apiDocs)},
+	}
+}
+
+func (s *WsServer) registerApi(public *http.ServeMux, admin *http.ServeMux) {
+	for _, e := range s.endpoints() {
+		route := apiPrefix + e.route
 		if e.method != "" {
 			route = fmt.Sprintf("%s %s", e.method, route)
 		}
@@ -163,13 +778,28 @@ func (s *WsServer) registerApi() {
 		if !e.protected {
 			caveat = " (unprotected)"
 		}
+		mux := public
+		if e.admin && admin != public {
+			mux = admin
+			caveat += " (admin)"
+		}
 		log.Debugf("creating api route: `%s`%s", route, caveat)
 
 		handler := e.handler
+		if e.requireAdmin {
+			handler = s.requireAdmin(handler)
+		}
 		if e.protected {
 			handler = s.bearerAuth(handler)
 		}
-		http.Handle(route, logMiddleware(handler))
+		mux.Handle(route, s.withMiddleware(route, handler))
+	}
+
+	// preflight requests do not match the method of any route
+	route := "OPTIONS " + apiPrefix + "/"
+	public.Handle(route, s.withMiddleware(route, http.HandlerFunc(s.apiOptions)))
+	if admin != public {
+		admin.Handle(route, s.withMiddleware(route, http.HandlerFunc(s.apiOptions)))
 	}
 }
 
@@ -185,29 +815,12 @@ func getBearerToken(r *http.Request) string {
 func writeJSON(w http.ResponseWriter, status int, data any) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
-		log.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+		log.Error("failed to encode response", "err", err)
+		status = http.StatusInternalServerError
+		bytes = []byte(`{"error":{"code":"` + CODE_INTERNAL + `","message":"Internal server error"}}`)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(bytes)
 }
-
-func writeErrorJSON(w http.ResponseWriter, status int, msg ...string) {
-	var err string
-	if len(msg) == 1 {
-		err = msg[0]
-	} else if len(msg) > 1 {
-		err = fmt.Sprintf(msg[0], msg[1:])
-	} else {
-		err = "User is not authorized to access resource"
-	}
-
-	writeJSON(w, status, obj{
-		"error": err,
-		"code":  status,
-	})
-}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"hello-go/common"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const auditPruneInterval = time.Hour
+
+// audit records an action in the audit log. `addr` is the remote `host:port` of the
+// request, the port is dropped.
+func (s *WsServer) audit(action string, actor string, target string, addr string, detail string) {
+	ip := ""
+	if addr, ok := addrIP(addr); ok {
+		ip = addr.String()
+	}
+
+	s.db.Audit(common.AuditEntry{
+		Action: action,
+		Actor:  actor,
+		Target: target,
+		IP:     ip,
+		Detail: detail,
+	})
+}
+
+// pruneAudit periodically removes audit entries older than the retention period.
+func (s *WsServer) pruneAudit() {
+	for {
+		n, err := s.db.PruneAudit(time.Now().Add(-s.cfg.AuditRetention))
+		if err != nil {
+			log.Error("failed to prune audit log", "err", err)
+		} else if n > 0 {
+			log.Info("pruned audit log", "entries", n, "retention", s.cfg.AuditRetention)
+		}
+
+		time.Sleep(auditPruneInterval)
+	}
+}
+
+// auditFilter reads the audit query parameters: `action`, `actor`, `target`, `since`
+// and `until` (RFC 3339), `before` (entry id) and `limit`.
+func auditFilter(r *http.Request) (common.AuditFilter, error) {
+	q := r.URL.Query()
+	f := common.AuditFilter{
+		Action: q.Get("action"),
+		Actor:  q.Get("actor"),
+		Target: q.Get("target"),
+	}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errInvalidField("since", "invalid `since` time `%s`", v)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, errInvalidField("until", "invalid `until` time `%s`", v)
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		if f.BeforeId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, errInvalidField("before", "invalid `before` id `%s`", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return f, errInvalidField("limit", "invalid `limit` `%s`", v)
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", requestIdHeader}
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+// corsPolicy adds CORS headers to API responses and answers preflight requests.
+// Origins are checked with the same originList as websocket upgrades.
+type corsPolicy struct {
+	origins     *originList
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      string
+}
+
+// newCORSPolicy validates the CORS settings. Credentials are rejected when every origin
+// is allowed, since any website could then make credentialed requests.
+func newCORSPolicy(cfg Config, origins *originList) (*corsPolicy, error) {
+	if cfg.CORSCredentials && origins.allowAll {
+		return nil, errors.New("CORS credentials cannot be allowed together with every origin")
+	}
+
+	methods := defaultCORSMethods
+	if len(cfg.CORSMethods) > 0 {
+		methods = make([]string, len(cfg.CORSMethods))
+		for i, m := range cfg.CORSMethods {
+			methods[i] = strings.ToUpper(strings.TrimSpace(m))
+		}
+	}
+	headers := cfg.CORSHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	maxAge := cfg.CORSMaxAge
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+
+	return &corsPolicy{
+		origins:     origins,
+		methods:     strings.Join(methods, ", "),
+		headers:     strings.Join(headers, ", "),
+		credentials: cfg.CORSCredentials,
+		maxAge:      strconv.Itoa(int(maxAge.Seconds())),
+	}, nil
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// middleware sets the CORS response headers for allowed origins. Preflight requests
+// are answered directly, requests from other origins are served without CORS headers
+// so browsers will not expose the response.
+func (c *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !c.origins.Allowed(origin) {
+			if isPreflight(r) {
+				writeError(w, r, errForbidden("Origin `%s` is not allowed", origin))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.origins.allowAll {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if isPreflight(r) {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", c.methods)
+			h.Set("Access-Control-Allow-Headers", c.headers)
+			h.Set("Access-Control-Max-Age", c.maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", requestIdHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiOptions answers `OPTIONS` requests which are not CORS preflights.
+func (s *WsServer) apiOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, "+s.cors.methods)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hello-go/common"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// errMuted is returned when a muted user tries to send or change a message.
+func (s *WsServer) errMuted(user string) error {
+	if m, ok := s.muted(user); ok {
+		return newApiError(
+			http.StatusForbidden, CODE_MUTED, "you are muted until %v: %s", m.until.Format(time.RFC3339), m.reason,
+		)
+	}
+	return nil
+}
+
+// findMessage returns a message `viewer` was entitled to receive, or any message when
+// `viewer` is empty. Deleted messages cannot be changed and are not found.
+func (s *WsServer) findMessage(id int64, viewer string) (*common.Message, error) {
+	m, err := s.db.GetMessage(id, viewer)
+	switch {
+	case err != nil:
+		return nil, err
+	case m == nil:
+		return nil, errNotFound("message %d not found", id)
+	case m.Deleted != nil:
+		return nil, errDeleted(id)
+	}
+	return m, nil
+}
+
+// errDeleted is returned for a message deleted since it was found, or before.
+func errDeleted(id int64) *apiError {
+	return errConflict("message %d was deleted", id)
+}
+
+// changed publishes an edit, delete or reaction event to the peers who can see the
+// message.
+func (s *WsServer) changed(m *common.Message, e common.Event) {
+	e.User = m.From
+	e.Room = m.Room
+	e.To = m.To
+	e.MessageId = m.Id
+	e.Bot = m.Bot
+	s.publish(e)
+}
+
+// editMessage replaces the text of a message `user` sent less than EditWindow ago.
+func (s *WsServer) editMessage(user string, e common.Edit) error {
+	if err := s.errMuted(user); err != nil {
+		return err
+	}
+	var v validation
+	e.Text = strings.TrimSpace(e.Text)
+	checkText(&v, e.Text)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	m, err := s.findMessage(e.MessageId, user)
+	switch {
+	case err != nil:
+		return err
+	case m.From != user || m.Bot:
+		return errForbidden("only the author can edit a message")
+	case time.Since(m.Time) > s.cfg.EditWindow:
+		return errForbidden("messages can only be edited for %v", s.cfg.EditWindow)
+	}
+
+	err = s.db.EditMessage(m, e.Text)
+	if errors.Is(err, common.ErrMessageDeleted) {
+		return errDeleted(m.Id)
+	}
+	if err != nil {
+		return err
+	}
+	s.changed(m, common.Event{Type: common.EVENT_EDIT, By: user, Text: m.Text})
+	return nil
+}
+
+// deleteMessage turns a message into a tombstone. Authors can delete their own
+// messages, and admins any message, which is recorded in the audit log.
+func (s *WsServer) deleteMessage(user string, addr string, d common.Delete) error {
+	admin := s.db.IsAdmin(user)
+	viewer := user
+	if admin {
+		viewer = ""
+	}
+	m, err := s.findMessage(d.MessageId, viewer)
+	if err != nil {
+		return err
+	}
+	own := m.From == user && !m.Bot
+	if !own && !admin {
+		return errForbidden("only the author or an admin can delete a message")
+	}
+
+	err = s.db.DeleteMessage(m, user)
+	if errors.Is(err, common.ErrMessageDeleted) {
+		return errDeleted(m.Id)
+	}
+	if err != nil {
+		return err
+	}
+	if !own {
+		s.audit(common.AUDIT_MESSAGE_DELETE, user, m.From, addr, fmt.Sprintf("message %d", m.Id))
+	}
+	s.changed(m, common.Event{Type: common.EVENT_DELETE, By: user})
+	return nil
+}
+
+// react adds or removes a reaction of `user`, who must be able to see the message and
+// be a member of its room.
+func (s *WsServer) react(user string, r common.Reaction) error {
+	if err := s.errMuted(user); err != nil {
+		return err
+	}
+	r.Emoji = strings.TrimSpace(r.Emoji)
+	if err := validEmoji(r.Emoji); err != nil {
+		return errInvalidField("emoji", "%v", err)
+	}
+
+	m, err := s.findMessage(r.MessageId, user)
+	if err != nil {
+		return err
+	}
+	if m.Room != "" {
+		s.RLock()
+		member := s.isMember(m.Room, user)
+		s.RUnlock()
+		if !member {
+			return errForbidden("not a member of #%s", m.Room)
+		}
+	}
+
+	changed, count, err := s.db.React(m.Id, user, r.Emoji, r.Remove)
+	if errors.Is(err, common.ErrMessageDeleted) {
+		return errDeleted(m.Id)
+	}
+	if err != nil || !changed {
+		return err
+	}
+	ty := common.EVENT_REACT
+	if r.Remove {
+		ty = common.EVENT_UNREACT
+	}
+	s.changed(m, common.Event{Type: ty, By: user, Emoji: r.Emoji, Count: count})
+	return nil
+}
+
+// validEmoji checks a reaction, which may be any short text without spaces since
+// emoji cannot be told apart reliably from other symbols.
+func validEmoji(emoji string) error {
+	switch {
+	case emoji == "":
+		return fmt.Errorf("emoji must not be empty")
+	case len(emoji) > common.MAX_EMOJI_LEN:
+		return fmt.Errorf("emoji must be at most %d bytes", common.MAX_EMOJI_LEN)
+	}
+	for _, c := range emoji {
+		// the zero width joiner combines emoji sequences
+		if unicode.IsSpace(c) || !unicode.IsPrint(c) && c != '\u200d' {
+			return fmt.Errorf("emoji contains invalid character %q", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"hello-go/common"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		ok    bool
+	}{
+		{"👍", true},
+		{"👍🏽", true},
+		{"❤️", true},
+		{"👩‍💻", true},
+		{":+1:", true},
+		{"", false},
+		{"two words", false},
+		{"tab\t", false},
+		{"\x00", false},
+		{strings.Repeat("🎉", 9), false},
+	}
+
+	for _, tt := range tests {
+		if err := validEmoji(tt.emoji); (err == nil) != tt.ok {
+			t.Errorf("validEmoji(%q) = %v, want ok %v", tt.emoji, err, tt.ok)
+		}
+	}
+}
+
+func wantStatus(t *testing.T, action string, err error, status int) {
+	t.Helper()
+	var e *apiError
+	switch {
+	case status == http.StatusOK && err != nil:
+		t.Errorf("%s failed: %v", action, err)
+	case status != http.StatusOK && (!errors.As(err, &e) || e.status != status):
+		t.Errorf("%s returned %v, want status %d", action, err, status)
+	}
+}
+
+func TestEditAndDelete(t *testing.T) {
+	s := newTestServer(t, Config{EditWindow: time.Hour})
+	if _, err := s.db.SetRole("carol", common.ROLE_ADMIN); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := s.joinRoom(user, "dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, err := s.postText("alice", common.Text{Room: "dev", Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &common.Message{From: "bob", Room: "dev", Text: "build passed", Bot: true}
+	if err := s.deliverMessage(bot); err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatus(t, "editing another user's message", s.editMessage("bob", common.Edit{MessageId: m.Id, Text: "hi"}), http.StatusForbidden)
+	wantStatus(t, "editing a bot message with the user's name", s.editMessage("bob", common.Edit{MessageId: bot.Id, Text: "hi"}), http.StatusForbidden)
+	wantStatus(t, "editing", s.editMessage("alice", common.Edit{MessageId: m.Id, Text: "hello all"}), http.StatusOK)
+	if edited, _ := s.db.GetMessage(m.Id, ""); edited.Text != "hello all" || edited.Edited == nil {
+		t.Errorf("edited message is %+v", edited)
+	}
+	s.cfg.EditWindow = time.Nanosecond
+	wantStatus(t, "editing after the edit window", s.editMessage("alice", common.Edit{MessageId: m.Id, Text: "hi"}), http.StatusForbidden)
+
+	wantStatus(t, "deleting another user's message", s.deleteMessage("bob", "", common.Delete{MessageId: m.Id}), http.StatusForbidden)
+	wantStatus(t, "deleting as an admin", s.deleteMessage("carol", "", common.Delete{MessageId: m.Id}), http.StatusOK)
+	entries, err := s.db.GetAudit(common.AuditFilter{Action: common.AUDIT_MESSAGE_DELETE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "carol" || entries[0].Target != "alice" {
+		t.Errorf("audit entries are %+v, want the delete by carol", entries)
+	}
+
+	s.cfg.EditWindow = time.Hour
+	wantStatus(t, "editing a deleted message", s.editMessage("alice", common.Edit{MessageId: m.Id, Text: "hi"}), http.StatusConflict)
+	wantStatus(t, "deleting a deleted message", s.deleteMessage("alice", "", common.Delete{MessageId: m.Id}), http.StatusConflict)
+	wantStatus(t, "reacting to a deleted message", s.react("bob", common.Reaction{MessageId: m.Id, Emoji: "👍"}), http.StatusConflict)
+}
+
+func TestReactionCounts(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := s.joinRoom(user, "dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, err := s.postText("alice", common.Text{Room: "dev", Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user   string
+		remove bool
+		count  int
+	}{
+		{"bob", false, 1},
+		{"alice", false, 2},
+		// reacting twice is counted once
+		{"bob", false, 2},
+		{"bob", true, 1},
+		{"bob", true, 1},
+		{"alice", true, 0},
+	}
+	for _, tt := range tests {
+		if err := s.react(tt.user, common.Reaction{MessageId: m.Id, Emoji: "👍", Remove: tt.remove}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.db.GetMessage(m.Id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Reactions["👍"] != tt.count {
+			t.Errorf("after %s reacted (remove %v) the count is %d, want %d", tt.user, tt.remove, got.Reactions["👍"], tt.count)
+		}
+	}
+
+	wantStatus(t, "reacting outside the room", s.react("carol", common.Reaction{MessageId: m.Id, Emoji: "👍"}), http.StatusNotFound)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hello-go/common"
+	"io"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+)
+
+// Stable machine-readable error codes returned in the `error.code` field of API
+// responses. Clients should match on these rather than on messages.
+const (
+	CODE_INVALID_REQUEST   = "invalid_request"
+	CODE_VALIDATION_FAILED = "validation_failed"
+	CODE_UNAUTHORIZED      = "unauthorized"
+	CODE_FORBIDDEN         = "forbidden"
+	CODE_BANNED            = "banned"
+	CODE_MUTED             = "muted"
+	CODE_NOT_FOUND         = "not_found"
+	CODE_CONFLICT          = "conflict"
+	CODE_TOO_LARGE         = "payload_too_large"
+	CODE_QUEUE_FULL        = "queue_full"
+	CODE_NOT_IMPLEMENTED   = "not_implemented"
+	CODE_INTERNAL          = "internal_error"
+)
+
+// maxBodySize is the largest JSON request body accepted by the API.
+const maxBodySize = 1 << 20
+
+// apiError is an error returned to API clients in the envelope
+// `{"error": {"code": ..., "message": ..., "fields": [...], "request_id": ...}}`.
+type apiError struct {
+	status    int
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []fieldError `json:"fields,omitempty"`
+	RequestId string       `json:"request_id,omitempty"`
+}
+
+// fieldError describes why a single request field failed validation.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newApiError(status int, code string, format string, args ...any) *apiError {
+	return &apiError{status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func errBadRequest(format string, args ...any) *apiError {
+	return newApiError(http.StatusBadRequest, CODE_INVALID_REQUEST, format, args...)
+}
+
+func errUnauthorized(format string, args ...any) *apiError {
+	return newApiError(http.StatusUnauthorized, CODE_UNAUTHORIZED, format, args...)
+}
+
+func errForbidden(format string, args ...any) *apiError {
+	return newApiError(http.StatusForbidden, CODE_FORBIDDEN, format, args...)
+}
+
+func errNotFound(format string, args ...any) *apiError {
+	return newApiError(http.StatusNotFound, CODE_NOT_FOUND, format, args...)
+}
+
+func errConflict(format string, args ...any) *apiError {
+	return newApiError(http.StatusConflict, CODE_CONFLICT, format, args...)
+}
+
+func errBanned(b *common.Ban) *apiError {
+	return newApiError(http.StatusForbidden, CODE_BANNED, "%s", banMessage(b))
+}
+
+// hasCode reports whether `err` is an apiError with the given code.
+func hasCode(err error, code string) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.Code == code
+}
+
+// errInvalidField is a validation error for a single field, using the field message
+// as the error message.
+func errInvalidField(field string, format string, args ...any) *apiError {
+	var v validation
+	v.add(field, format, args...)
+	return v.err().(*apiError)
+}
+
+// validation collects field errors so every invalid field is reported at once.
+type validation struct {
+	fields []fieldError
+}
+
+func (v *validation) add(field string, format string, args ...any) {
+	v.fields = append(v.fields, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// check adds a field error if `ok` is false.
+func (v *validation) check(ok bool, field string, format string, args ...any) {
+	if !ok {
+		v.add(field, format, args...)
+	}
+}
+
+// err returns the collected field errors as an apiError, or nil if there are none.
+func (v *validation) err() error {
+	switch len(v.fields) {
+	case 0:
+		return nil
+	case 1:
+		e := newApiError(http.StatusBadRequest, CODE_VALIDATION_FAILED, "%s", v.fields[0].Message)
+		e.Fields = v.fields
+		return e
+	default:
+		e := newApiError(http.StatusBadRequest, CODE_VALIDATION_FAILED, "%d fields are invalid", len(v.fields))
+		e.Fields = v.fields
+		return e
+	}
+}
+
+// decodeJSON reads a JSON request body into `v`, mapping decode failures to client
+// errors.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var sizeErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, io.EOF):
+		return errBadRequest("request body is required")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return errInvalidField(typeErr.Field, "`%s` must be of type %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &sizeErr):
+		return newApiError(http.StatusRequestEntityTooLarge, CODE_TOO_LARGE, "request body exceeds %d bytes", sizeErr.Limit)
+	default:
+		return errBadRequest("malformed JSON body")
+	}
+}
+
+// writeError writes `err` in the API error envelope. Errors which are not an apiError
+// are logged and reported as an internal error without exposing their details.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		log.Error("api request failed", "request_id", requestId(r), "route", requestRoute(r), "err", err)
+		e = newApiError(http.StatusInternalServerError, CODE_INTERNAL, "Internal server error")
+	}
+
+	body := *e
+	body.RequestId = requestId(r)
+	writeJSON(w, e.status, obj{"error": body})
+}
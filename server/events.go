@@ -0,0 +1,148 @@
+package server
+
+import (
+	"hello-go/common"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBufferSize is the number of recent events kept to resume SSE streams.
+	eventBufferSize = 1024
+	// subscriberQueueSize is the number of events buffered for an SSE subscriber before
+	// it is dropped and must resume with `Last-Event-ID`.
+	subscriberQueueSize = 256
+)
+
+// subscriber receives the events visible to `user`, optionally limited to `rooms`.
+type subscriber struct {
+	user  string
+	rooms []string
+	ch    chan common.Event
+	// closed when the subscriber falls too far behind
+	dropped chan struct{}
+}
+
+func (sub *subscriber) wants(e *common.Event) bool {
+	return len(sub.rooms) == 0 || slices.Contains(sub.rooms, e.Room)
+}
+
+// eventBus assigns ids to events and keeps the most recent ones so that subscribers
+// can resume after reconnecting.
+type eventBus struct {
+	sync.Mutex
+	seq    uint64
+	recent []common.Event
+	subs   map[*subscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*subscriber]struct{})}
+}
+
+// publish sends an event to every peer and subscriber allowed to see it. Events are
+// delivered in id order. It returns the peers the event was sent to.
+func (s *WsServer) publish(e common.Event) []*Peer {
+	b := s.events
+	b.Lock()
+	defer b.Unlock()
+
+	b.seq++
+	e.Id = b.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(b.recent) == eventBufferSize {
+		b.recent = slices.Delete(b.recent, 0, 1)
+	}
+	b.recent = append(b.recent, e)
+
+	packet := common.NewJSONPacket(common.PACKET_EVENT, e)
+	s.RLock()
+	defer s.RUnlock()
+	var sent []*Peer
+	for p := range s.peers {
+		if s.canSee(p.user, &e) && p.send(packet) {
+			sent = append(sent, p)
+		}
+	}
+	for sub := range b.subs {
+		if !sub.wants(&e) || !s.canSee(sub.user, &e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.dropped)
+		}
+	}
+
+	return sent
+}
+
+// subscribe registers a subscriber and returns the buffered events after `lastId`
+// which it is allowed to see.
+func (s *WsServer) subscribe(sub *subscriber, lastId uint64) []common.Event {
+	b := s.events
+	b.Lock()
+	defer b.Unlock()
+
+	sub.ch = make(chan common.Event, subscriberQueueSize)
+	sub.dropped = make(chan struct{})
+	b.subs[sub] = struct{}{}
+
+	var backlog []common.Event
+	if lastId == 0 {
+		return backlog
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, e := range b.recent {
+		if e.Id > lastId && sub.wants(&e) && s.canSee(sub.user, &e) {
+			backlog = append(backlog, e)
+		}
+	}
+
+	return backlog
+}
+
+func (s *WsServer) unsubscribe(sub *subscriber) {
+	s.events.Lock()
+	defer s.events.Unlock()
+	delete(s.events.subs, sub)
+}
+
+// closeStreams ends the event streams of `user`, returning the number closed.
+func (s *WsServer) closeStreams(user string) int {
+	s.events.Lock()
+	defer s.events.Unlock()
+
+	n := 0
+	for sub := range s.events.subs {
+		if sub.user == user {
+			delete(s.events.subs, sub)
+			close(sub.dropped)
+			n++
+		}
+	}
+	return n
+}
+
+// canSee reports whether `user` may receive the event. Direct messages are only seen
+// by the sender and recipient, and room events by members of the room and the user
+// who sent, joined or left it. A bot sender is not a user. Presence changes are sent
+// to users sharing a room with the user. It must be called with the server lock held.
+func (s *WsServer) canSee(user string, e *common.Event) bool {
+	switch {
+	case e.Type == common.EVENT_PRESENCE:
+		return user == e.User || s.sharesRoom(user, e.User)
+	case e.To != "":
+		return user == e.User || user == e.To
+	case e.Room != "":
+		return (user == e.User && !e.Bot) || s.isMember(e.Room, user)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hello-go/common"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// incomingPayload is the body accepted by incoming webhooks, `{"text", "username"}`.
+// This is also the core of a Slack incoming webhook payload, and Slack blocks and
+// attachments are used when there is no text. Other Slack fields are ignored.
+type incomingPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+	Blocks   []struct {
+		Type string `json:"type"`
+		Text *struct {
+			Text string `json:"text"`
+		} `json:"text"`
+	} `json:"blocks"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Pretext  string `json:"pretext"`
+		Title    string `json:"title"`
+		Text     string `json:"text"`
+	} `json:"attachments"`
+}
+
+// slackLink matches Slack link, mention and command markup such as `<url|label>`,
+// `<@U123|bob>` and `<!here>`.
+var slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+
+// message returns the plain text of the payload.
+func (p *incomingPayload) message() string {
+	var lines []string
+	if p.Text != "" {
+		lines = append(lines, p.Text)
+	}
+	if len(lines) == 0 {
+		for _, b := range p.Blocks {
+			if (b.Type == "section" || b.Type == "header") && b.Text != nil && b.Text.Text != "" {
+				lines = append(lines, b.Text.Text)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		for _, a := range p.Attachments {
+			if a.Fallback != "" {
+				lines = append(lines, a.Fallback)
+				continue
+			}
+			for _, t := range []string{a.Pretext, a.Title, a.Text} {
+				if t != "" {
+					lines = append(lines, t)
+				}
+			}
+		}
+	}
+
+	return slackText(strings.Join(lines, "\n"))
+}
+
+// slackText converts Slack formatting to plain text. Links become `label (url)`,
+// mentions keep their label and the `&amp;`, `&lt;` and `&gt;` escapes are decoded.
+func slackText(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(m string) string {
+		sub := slackLink.FindStringSubmatch(m)
+		target, label := sub[1], sub[2]
+		switch {
+		case strings.HasPrefix(target, "!"):
+			if label != "" {
+				return label
+			}
+			return "@" + target[1:]
+		case strings.HasPrefix(target, "@") || strings.HasPrefix(target, "#"):
+			if label != "" {
+				return target[:1] + strings.TrimLeft(label, "@#")
+			}
+			return target
+		case label != "":
+			return fmt.Sprintf("%s (%s)", label, target)
+		default:
+			return target
+		}
+	})
+
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
+
+// decodeIncoming reads an incoming webhook body, which is JSON or a form with the JSON
+// in its `payload` field as sent by some Slack integrations. Bodies are sniffed rather
+// than trusting the content type, since many tools send JSON as a form.
+func decodeIncoming(w http.ResponseWriter, r *http.Request, p *incomingPayload) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	var sizeErr *http.MaxBytesError
+	if errors.As(err, &sizeErr) {
+		return newApiError(http.StatusRequestEntityTooLarge, CODE_TOO_LARGE, "request body exceeds %d bytes", sizeErr.Limit)
+	}
+	if err != nil {
+		return errBadRequest("failed to read request body")
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("payload") == "" {
+			return errBadRequest("body must be JSON or a form with a `payload` field")
+		}
+		body = []byte(form.Get("payload"))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return decodeJSON(w, r, p)
+}
+
+// validBotName checks a bot sender name, which unlike a username may contain spaces
+// and other printable characters.
+func validBotName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("username must not be empty")
+	case len(name) > common.MAX_USERNAME_LEN:
+		return fmt.Errorf("username must be at most %d characters", common.MAX_USERNAME_LEN)
+	}
+	for _, c := range name {
+		if !unicode.IsPrint(c) {
+			return fmt.Errorf("username contains invalid character %q", c)
+		}
+	}
+
+	return nil
+}
+
+// apiIncomingWebhook posts a bot message to the room of the incoming webhook with the
+// `token` path value.
+func (s *WsServer) apiIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	h, err := s.db.FindIncomingWebhook(r.PathValue("token"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if h == nil {
+		writeError(w, r, errNotFound("Webhook not found"))
+		return
+	}
+
+	var p incomingPayload
+	if err := decodeIncoming(w, r, &p); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	m := &common.Message{From: h.Username, Room: h.Room, Text: strings.TrimSpace(p.message()), Bot: true}
+	if name := strings.TrimSpace(p.Username); name != "" {
+		m.From = name
+	}
+	var v validation
+	checkText(&v, m.Text)
+	if err := validBotName(m.From); err != nil {
+		v.add("username", "%v", err)
+	}
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := s.deliverMessage(m); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
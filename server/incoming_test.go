@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"hello-go/common"
+	"testing"
+)
+
+func TestIncomingPayloadText(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain", `{"text": "build #42 passed", "username": "ci"}`, "build #42 passed"},
+		{"slack link", `{"text": "Deployed <https://ci.example.com/42|build 42> to prod"}`, "Deployed build 42 (https://ci.example.com/42) to prod"},
+		{"slack bare link", `{"text": "see <https://example.com>"}`, "see https://example.com"},
+		{"slack mentions", `{"text": "<!here> <@U123|bob> in <#C1|ops>"}`, "@here @bob in #ops"},
+		{"slack escapes", `{"text": "a &lt; b &amp;&amp; c &gt; d"}`, "a < b && c > d"},
+		{"slack blocks", `{"blocks": [{"type": "header", "text": {"type": "plain_text", "text": "Release"}}, {"type": "divider"}, {"type": "section", "text": {"type": "mrkdwn", "text": "v1.2 is out"}}]}`, "Release\nv1.2 is out"},
+		{"slack attachment fallback", `{"attachments": [{"fallback": "Build failed", "title": "ignored"}]}`, "Build failed"},
+		{"slack attachment fields", `{"attachments": [{"pretext": "Nightly", "title": "Tests", "text": "3 failures"}]}`, "Nightly\nTests\n3 failures"},
+		{"text wins", `{"text": "hello", "attachments": [{"fallback": "ignored"}]}`, "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p incomingPayload
+			if err := json.Unmarshal([]byte(tt.body), &p); err != nil {
+				t.Fatalf("invalid test payload: %v", err)
+			}
+			if got := p.message(); got != tt.want {
+				t.Errorf("message() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotMessagesDoNotMatchSender(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if _, err := s.joinRoom("bob", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.deliverMessage(&common.Message{From: "alice", Room: "dev", Text: "deploy now", Bot: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := s.db.GetMessages(common.MessageFilter{Viewer: "bob", From: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("a bot named alice is listed as sent by alice: %v", history)
+	}
+}
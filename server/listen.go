@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+const unixPrefix = "unix:"
+
+// parseListenAddr splits a listen address into a network and address. Addresses are
+// either `host:port` (`[::1]:3000`, `:3000`) or `unix:/path/to/socket`.
+func parseListenAddr(addr string) (network string, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("listen address `%s` is missing a socket path", addr)
+		}
+		return "unix", path, nil
+	}
+
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address `%s`: %w", addr, err)
+	}
+	return "tcp", addr, nil
+}
+
+// listen opens a listener for an address accepted by parseListenAddr. Stale unix
+// sockets left behind by a previous run are removed first.
+func listen(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode().Type() == fs.ModeSocket {
+			log.Debugf("removing stale socket `%s`", address)
+			os.Remove(address)
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+// listenAll opens a listener for every address, closing any already opened if one
+// fails.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func listenerAddrs(listeners []net.Listener) []string {
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().Network() + "://" + l.Addr().String()
+	}
+
+	return addrs
+}
+
+// isUnix reports whether the listener is a unix domain socket.
+func isUnix(l net.Listener) bool {
+	return l.Addr().Network() == "unix"
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hello-go/common"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// decodeText reads a text packet payload, which is either a JSON encoded Text or plain
+// text to broadcast.
+func decodeText(payload []byte) (common.Text, error) {
+	var t common.Text
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		t.Text = string(payload)
+		return t, nil
+	}
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return t, errBadRequest("invalid text payload: %v", err)
+	}
+	return t, nil
+}
+
+// postText validates and stores a message from `user`, then publishes it to the room,
+// recipient or every connected user. Websocket text packets and the REST API both send
+// messages through here. A message resent with the same client id is not delivered
+// again, the stored message is returned with `duplicate` set instead.
+func (s *WsServer) postText(user string, t common.Text) (m *common.Message, duplicate bool, err error) {
+	if t.Id != "" && len(t.Id) <= common.MAX_CLIENT_ID_LEN {
+		if m, err := s.db.FindClientMessage(user, t.Id); err != nil || m != nil {
+			return m, m != nil, err
+		}
+	}
+
+	if err := s.errMuted(user); err != nil {
+		return nil, false, err
+	}
+
+	var v validation
+	t.Text = strings.TrimSpace(t.Text)
+	checkText(&v, t.Text)
+	v.check(len(t.Id) <= common.MAX_CLIENT_ID_LEN, "id", "id must be at most %d bytes", common.MAX_CLIENT_ID_LEN)
+	v.check(t.Room == "" || t.To == "", "to", "a message cannot have both a room and a recipient")
+	if t.Room != "" {
+		room, err := common.NormalizeRoom(t.Room)
+		if err != nil {
+			v.add("room", "%v", err)
+		}
+		t.Room = room
+	}
+	if t.To != "" && !s.db.UserExists(t.To) {
+		v.add("to", "no user `%s`", t.To)
+	}
+	if err := v.err(); err != nil {
+		return nil, false, err
+	}
+	if t.ParentId != 0 {
+		if err := s.inThread(user, &t); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if t.Room != "" {
+		s.RLock()
+		member := s.isMember(t.Room, user)
+		s.RUnlock()
+		if !member {
+			return nil, false, errForbidden("not a member of #%s", t.Room)
+		}
+	}
+
+	m = &common.Message{From: user, Room: t.Room, To: t.To, Text: t.Text, ClientId: t.Id, ParentId: t.ParentId}
+	if t.To != "" {
+		m.Delivery = s.deliveryFor(t.To)
+	}
+	err = s.deliverMessage(m)
+	if errors.Is(err, common.ErrDuplicateMessage) {
+		// another session stored it since it was looked up
+		m, err = s.db.FindClientMessage(user, t.Id)
+		return m, true, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// sending the message ends typing it
+	s.signals.stopTyping(signalKey{user: user, room: t.Room, to: t.To}, nil)
+	return m, false, nil
+}
+
+func checkText(v *validation, text string) {
+	v.check(text != "", "text", "text must not be empty")
+	v.check(len(text) <= common.MAX_TEXT_LEN, "text", "text must be at most %d bytes", common.MAX_TEXT_LEN)
+}
+
+// deliverMessage stores a validated message and publishes it. Direct messages with
+// DELIVERY_QUEUED are queued for their recipient unless their queue is full or they
+// connected in the meantime. Direct messages are private and bot messages could loop
+// back to their source, so neither is sent to outbound webhooks.
+func (s *WsServer) deliverMessage(m *common.Message) error {
+	queued := m.Delivery == common.DELIVERY_QUEUED
+	var err error
+	if queued {
+		// the recipient must not claim their queue between storing and publishing
+		s.queueMu.Lock()
+		defer s.queueMu.Unlock()
+		if err := s.checkQueueLimit(m.To); err != nil {
+			return err
+		}
+		err = s.db.CreateQueuedMessage(m, time.Now().Add(s.cfg.OfflineQueueTTL))
+	} else {
+		err = s.db.CreateMessage(m)
+	}
+	if err != nil {
+		return err
+	}
+
+	sent := s.publish(common.Event{
+		Type:      common.EVENT_MESSAGE,
+		Time:      m.Time,
+		User:      m.From,
+		Room:      m.Room,
+		To:        m.To,
+		Text:      m.Text,
+		MessageId: m.Id,
+		Bot:       m.Bot,
+		ParentId:  m.ParentId,
+		Queued:    queued,
+	})
+	if queued && slices.ContainsFunc(sent, func(p *Peer) bool { return p.user == m.To }) {
+		// the recipient connected after the message was queued and received it live
+		if err := s.db.UnqueueMessage(m.Id); err != nil {
+			log.Error("failed to dequeue a message delivered live", "err", err, "message", m.Id)
+		} else {
+			m.Delivery = common.DELIVERY_LIVE
+		}
+	}
+	if m.To == "" && !m.Bot {
+		s.webhooks.dispatch(common.HOOK_MESSAGE, m, m)
+	}
+	return nil
+}
+
+// messageFilter reads the history query parameters: `room`, `from`, `with` (direct
+// message partner), `since` and `until` (RFC 3339), `q` (FTS5 query), `before`
+// (message id) and `limit`.
+func messageFilter(r *http.Request) (common.MessageFilter, error) {
+	q := r.URL.Query()
+	f := common.MessageFilter{
+		Viewer: requestUser(r),
+		From:   q.Get("from"),
+		With:   q.Get("with"),
+		Query:  strings.TrimSpace(q.Get("q")),
+	}
+
+	var v validation
+	var err error
+	if room := q.Get("room"); room != "" {
+		if f.Room, err = common.NormalizeRoom(room); err != nil {
+			v.add("room", "%v", err)
+		}
+	}
+	v.check(f.Room == "" || f.With == "", "with", "`room` and `with` cannot be combined")
+	if s := q.Get("since"); s != "" {
+		f.Since, err = time.Parse(time.RFC3339, s)
+		v.check(err == nil, "since", "invalid `since` time `%s`", s)
+	}
+	if s := q.Get("until"); s != "" {
+		f.Until, err = time.Parse(time.RFC3339, s)
+		v.check(err == nil, "until", "invalid `until` time `%s`", s)
+	}
+	if s := q.Get("before"); s != "" {
+		f.BeforeId, err = strconv.ParseInt(s, 10, 64)
+		v.check(err == nil && f.BeforeId > 0, "before", "invalid `before` id `%s`", s)
+	}
+	if s := q.Get("limit"); s != "" {
+		f.Limit, err = strconv.Atoi(s)
+		v.check(err == nil && f.Limit > 0, "limit", "invalid `limit` `%s`", s)
+	}
+	if f.Limit <= 0 || f.Limit > common.MAX_MESSAGE_PAGE {
+		f.Limit = common.MAX_MESSAGE_PAGE
+	}
+
+	return f, v.err()
+}
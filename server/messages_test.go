@@ -0,0 +1,121 @@
+package server
+
+import (
+	"hello-go/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+// received drains the write queue of `p` and returns the packets of type `ty`.
+func received(p *Peer, ty string) []*common.RawPacket {
+	var packets []*common.RawPacket
+	for {
+		select {
+		case packet := <-p.tx:
+			if raw, ok := packet.(*common.RawPacket); ok && raw.Type == ty {
+				packets = append(packets, raw)
+			}
+		default:
+			return packets
+		}
+	}
+}
+
+func TestTextIsAcknowledged(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := s.joinRoom(user, "dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, bob := testPeer(s, "alice"), testPeer(s, "bob")
+
+	var first int64
+	tests := []struct {
+		name      string
+		payload   string
+		duplicate bool
+		rejected  bool
+		delivered int
+	}{
+		{"new", `{"id": "a1", "room": "dev", "text": "hello"}`, false, false, 1},
+		{"resent", `{"id": "a1", "room": "dev", "text": "hello"}`, true, false, 0},
+		{"not a member", `{"id": "a2", "room": "ops", "text": "hello"}`, false, true, 0},
+		{"empty", `{"id": "a3", "room": "dev", "text": " "}`, false, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.handleText(alice, &common.RawPacket{Type: common.PACKET_TEXT, Payload: []byte(tt.payload)})
+
+			acks := received(alice, common.PACKET_ACK)
+			if len(acks) != 1 {
+				t.Fatalf("received %d acks, want 1", len(acks))
+			}
+			var a common.Ack
+			if err := acks[0].Decode(&a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Duplicate != tt.duplicate || (a.Error != "") != tt.rejected || (a.MessageId != 0) == tt.rejected {
+				t.Errorf("ack is %+v, want duplicate %v and rejected %v", a, tt.duplicate, tt.rejected)
+			}
+			if first == 0 {
+				first = a.MessageId
+			} else if tt.duplicate && a.MessageId != first {
+				t.Errorf("duplicate is message %d, want %d", a.MessageId, first)
+			}
+			if n := len(received(bob, common.PACKET_EVENT)); n != tt.delivered {
+				t.Errorf("bob received %d messages, want %d", n, tt.delivered)
+			}
+		})
+	}
+
+	// messages without an id and failures which may succeed when resent are not
+	// acknowledged
+	s.handleText(alice, &common.RawPacket{Type: common.PACKET_TEXT, Payload: []byte(`{"room": "ops", "text": "hello"}`)})
+	s.db.Close()
+	s.handleText(alice, &common.RawPacket{Type: common.PACKET_TEXT, Payload: []byte(`{"id": "a4", "room": "dev", "text": "hello"}`)})
+	if n := len(received(alice, common.PACKET_NOTICE)); n != 2 {
+		t.Errorf("received %d notices, want 2", n)
+	}
+}
+
+func TestConcurrentResendIsStoredOnce(t *testing.T) {
+	s := newTestServer(t, Config{OfflineQueueLimit: 10, OfflineQueueTTL: time.Hour})
+
+	// storing messages to offline users waits for the queue lock, so every session
+	// looks up the client id before one of them stores the message
+	s.queueMu.Lock()
+	var mu sync.Mutex
+	ids := make(map[int64]int)
+	stored := 0
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, duplicate, err := s.postText("alice", common.Text{Id: "a1", To: "bob", Text: "hello"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ids[m.Id]++
+			if !duplicate {
+				stored++
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.queueMu.Unlock()
+	wg.Wait()
+
+	if len(ids) != 1 || stored != 1 {
+		t.Errorf("stored %d messages with ids %v, want one", stored, ids)
+	}
+	if n, _ := s.db.CountQueued("bob"); n != 1 {
+		t.Errorf("queued %d messages, want 1", n)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the histogram upper bounds in seconds, matching the Prometheus
+// client defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// counterVec is a set of counters keyed by a single label value.
+type counterVec struct {
+	sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func (c *counterVec) Add(label string, n uint64) {
+	c.Lock()
+	if c.values == nil {
+		c.values = make(map[string]*atomic.Uint64)
+	}
+	v, ok := c.values[label]
+	if !ok {
+		v = &atomic.Uint64{}
+		c.values[label] = v
+	}
+	c.Unlock()
+
+	v.Add(n)
+}
+
+func (c *counterVec) Inc(label string) {
+	c.Add(label, 1)
+}
+
+func (c *counterVec) snapshot() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	out := make(map[string]uint64, len(c.values))
+	for k, v := range c.values {
+		out[k] = v.Load()
+	}
+	return out
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a set of latency histograms keyed by a single label value.
+type histogramVec struct {
+	sync.Mutex
+	values map[string]*histogram
+}
+
+func (h *histogramVec) Observe(label string, d time.Duration) {
+	secs := d.Seconds()
+
+	h.Lock()
+	defer h.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogram)
+	}
+	v, ok := h.values[label]
+	if !ok {
+		v = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		h.values[label] = v
+	}
+
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			v.counts[i]++
+		}
+	}
+	v.sum += secs
+	v.count++
+}
+
+// metrics holds the server counters exported at `/metrics`. Gauges are read from the
+// server state when scraped.
+type metrics struct {
+	connects     atomic.Uint64
+	disconnects  atomic.Uint64
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	otpIssued    atomic.Uint64
+	otpRedeemed  atomic.Uint64
+	packetsIn    counterVec
+	packetsOut   counterVec
+	authFailures counterVec
+	apiLatency   histogramVec
+	dbLatency    histogramVec
+}
+
+func (s *WsServer) apiMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	s.writeMetrics(w)
+}
+
+func (s *WsServer) writeMetrics(w io.Writer) {
+	m := s.metrics
+
+	s.RLock()
+	peers := len(s.peers)
+	queued := 0
+	for p := range s.peers {
+		queued += len(p.tx)
+	}
+	s.RUnlock()
+
+	writeMetric(w, "hello_go_peers", "gauge", "Connected websocket peers.", "", float64(peers))
+	writeMetric(w, "hello_go_write_queue_depth", "gauge", "Packets waiting in peer write queues.", "", float64(queued))
+	writeMetric(w, "hello_go_connects_total", "counter", "Websocket connections opened.", "", float64(m.connects.Load()))
+	writeMetric(w, "hello_go_disconnects_total", "counter", "Websocket connections closed.", "", float64(m.disconnects.Load()))
+	writeMetric(w, "hello_go_received_bytes_total", "counter", "Websocket bytes received.", "", float64(m.bytesIn.Load()))
+	writeMetric(w, "hello_go_sent_bytes_total", "counter", "Websocket bytes sent.", "", float64(m.bytesOut.Load()))
+	writeMetric(w, "hello_go_otp_issued_total", "counter", "One-time passwords issued.", "", float64(m.otpIssued.Load()))
+	writeMetric(w, "hello_go_otp_redeemed_total", "counter", "One-time passwords redeemed.", "", float64(m.otpRedeemed.Load()))
+	writeCounterVec(w, "hello_go_received_packets_total", "Packets received by type.", "type", &m.packetsIn)
+	writeCounterVec(w, "hello_go_sent_packets_total", "Packets sent by type.", "type", &m.packetsOut)
+	writeCounterVec(w, "hello_go_auth_failures_total", "Failed authentication attempts by method.", "method", &m.authFailures)
+	writeHistogramVec(w, "hello_go_api_request_duration_seconds", "API request latency by route.", "route", &m.apiLatency)
+	writeHistogramVec(w, "hello_go_db_query_duration_seconds", "Database query latency by query.", "query", &m.dbLatency)
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, labels string, value float64) {
+	writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func writeCounterVec(w io.Writer, name string, help string, label string, c *counterVec) {
+	writeHeader(w, name, "counter", help)
+	values := c.snapshot()
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, quoteLabel(k), values[k])
+	}
+}
+
+func writeHistogramVec(w io.Writer, name string, help string, label string, h *histogramVec) {
+	writeHeader(w, name, "histogram", help)
+
+	h.Lock()
+	defer h.Unlock()
+	for _, k := range sortedKeys(h.values) {
+		v := h.values[k]
+		l := fmt.Sprintf("%s=%s", label, quoteLabel(k))
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, formatFloat(le), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, v.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, v.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func quoteLabel(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+	return `"` + v + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"hello-go/common"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/charmbracelet/log"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+const (
+	requestIdHeader = "X-Request-ID"
+	maxRequestIdLen = 128
+)
+
+type ctxKey int
+
+const requestInfoCtxKey ctxKey = iota
+
+// requestInfo is shared by the middleware chain and handlers through the request
+// context, so outer middleware can see values set by inner ones.
+type requestInfo struct {
+	id   string
+	user string
+	// route is the pattern the request matched, logged instead of the path which may
+	// contain a secret such as an incoming webhook token
+	route string
+}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoCtxKey).(*requestInfo)
+	return info
+}
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps `h` with each middleware, the first being the outermost.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// withMiddleware applies the standard middleware chain to a route handler.
+func (s *WsServer) withMiddleware(route string, h http.Handler) http.Handler {
+	return chain(h, requestIdMiddleware, s.accessLog(route), recoverPanic, s.cors.middleware)
+}
+
+// requestId returns the id assigned to the request by requestIdMiddleware.
+func requestId(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// requestUser returns the user authenticated by bearerAuth.
+func requestUser(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.user
+	}
+	return ""
+}
+
+// requestRoute returns the route pattern recorded by accessLog.
+func requestRoute(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.route
+	}
+	return ""
+}
+
+// requestIdMiddleware propagates a valid `X-Request-ID` header or assigns a new id, and
+// echoes it in the response.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = gonanoid.Must(16)
+		}
+
+		w.Header().Set(requestIdHeader, id)
+		ctx := context.WithValue(r.Context(), requestInfoCtxKey, &requestInfo{id: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog logs each request after the response is written and records its latency
+// under `route`.
+func (s *WsServer) accessLog(route string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info := getRequestInfo(r); info != nil {
+				info.route = route
+			}
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			elapsed := time.Since(start)
+			s.metrics.apiLatency.Observe(route, elapsed)
+			log.Info(
+				"api request",
+				"request_id", requestId(r),
+				"method", r.Method,
+				"route", route,
+				"status", rec.Status(),
+				"bytes", rec.bytes,
+				"duration", elapsed,
+				"remote", r.RemoteAddr,
+				"user", requestUser(r),
+				"authorization", common.RedactHeader(r.Header.Get("Authorization")),
+			)
+		})
+	}
+}
+
+// recoverPanic converts a panicking handler into a JSON 500 response. If the handler
+// already started writing, the connection is aborted instead.
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := w.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: w}
+		}
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			log.Error(
+				"panic in handler",
+				"request_id", requestId(r),
+				"route", requestRoute(r),
+				"err", err,
+				"stack", string(debug.Stack()),
+			)
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rec, r, newApiError(http.StatusInternalServerError, CODE_INTERNAL, "Internal server error"))
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
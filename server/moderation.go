@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"hello-go/common"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	ACTION_KICK   = "kick"
+	ACTION_MUTE   = "mute"
+	ACTION_UNMUTE = "unmute"
+	ACTION_BAN    = "ban"
+	ACTION_UNBAN  = "unban"
+)
+
+type mute struct {
+	until  time.Time
+	reason string
+}
+
+// moderate performs a moderation action on behalf of `actor` connected from `addr`,
+// returning a summary of the result. Both the REST API and command packets use this.
+func (s *WsServer) moderate(actor string, addr string, c common.Command) (string, error) {
+	if c.Target == "" {
+		return "", errInvalidField("target", "missing target")
+	}
+	reason := c.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+
+	switch c.Action {
+	case ACTION_KICK:
+		n := s.kick(c.Target, "kicked by "+actor+": "+reason)
+		if n == 0 {
+			return "", errNotFound("no connection or user `%s`", c.Target)
+		}
+		s.audit(common.AUDIT_KICK, actor, c.Target, addr, reason)
+		return fmt.Sprintf("kicked %d session(s) of `%s`", n, c.Target), nil
+
+	case ACTION_MUTE:
+		d, err := time.ParseDuration(c.Duration)
+		if err != nil || d <= 0 {
+			return "", errInvalidField("duration", "invalid duration `%s`", c.Duration)
+		}
+		if !s.db.UserExists(c.Target) {
+			return "", errNotFound("no user `%s`", c.Target)
+		}
+		s.mute(c.Target, d, reason)
+		s.audit(common.AUDIT_MUTE, actor, c.Target, addr, fmt.Sprintf("%v: %s", d, reason))
+		return fmt.Sprintf("muted `%s` for %v", c.Target, d), nil
+
+	case ACTION_UNMUTE:
+		if !s.unmute(c.Target) {
+			return "", errConflict("user `%s` is not muted", c.Target)
+		}
+		s.audit(common.AUDIT_UNMUTE, actor, c.Target, addr, "")
+		return fmt.Sprintf("unmuted `%s`", c.Target), nil
+
+	case ACTION_BAN:
+		b := &common.Ban{Kind: common.BAN_USER, Value: c.Target, Reason: reason, CreatedBy: actor}
+		if isIPOrPrefix(c.Target) {
+			b.Kind = common.BAN_IP
+		}
+		if c.Duration != "" {
+			d, err := time.ParseDuration(c.Duration)
+			if err != nil || d <= 0 {
+				return "", errInvalidField("duration", "invalid duration `%s`", c.Duration)
+			}
+			t := time.Now().Add(d)
+			b.Expires = &t
+		}
+		if err := s.ban(b, addr); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("banned %s `%s` (id %d)", b.Kind, b.Value, b.Id), nil
+
+	case ACTION_UNBAN:
+		id, err := strconv.ParseInt(c.Target, 10, 64)
+		if err != nil {
+			return "", errInvalidField("id", "invalid ban id `%s`", c.Target)
+		}
+		ok, err := s.db.DeleteBan(id)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errNotFound("no ban with id %d", id)
+		}
+		log.Infof("UNBAN id %d by `%s`", id, actor)
+		s.audit(common.AUDIT_UNBAN, actor, c.Target, addr, "")
+		return fmt.Sprintf("removed ban %d", id), nil
+	}
+
+	return "", errInvalidField("action", "unknown action `%s`", c.Action)
+}
+
+// kick disconnects the peer with id `target`, or every session of the user `target`,
+// returning the number of peers disconnected and event streams closed.
+func (s *WsServer) kick(target string, reason string) int {
+	n := s.disconnectWhere(reason, func(p *Peer) bool {
+		return p.id == target || p.user == target
+	})
+	return n + s.closeStreams(target)
+}
+
+// disconnectWhere notifies and disconnects every peer matching `pred`.
+func (s *WsServer) disconnectWhere(reason string, pred func(*Peer) bool) int {
+	s.RLock()
+	defer s.RUnlock()
+
+	n := 0
+	for p := range s.peers {
+		if pred(p) {
+			p.logger.Info("KICK", "reason", reason)
+			p.disconnect(reason)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *WsServer) mute(user string, d time.Duration, reason string) {
+	until := time.Now().Add(d)
+
+	s.Lock()
+	s.mutes[user] = mute{until: until, reason: reason}
+	s.Unlock()
+
+	log.Infof("MUTE `%s` until %v: %s", user, until.Format(time.RFC3339), reason)
+	s.notifyUser(user, "you have been muted for %v: %s", d, reason)
+}
+
+func (s *WsServer) unmute(user string) bool {
+	s.Lock()
+	_, ok := s.mutes[user]
+	delete(s.mutes, user)
+	s.Unlock()
+
+	if ok {
+		s.notifyUser(user, "you are no longer muted")
+	}
+	return ok
+}
+
+// muted returns the active mute for a user, removing it if it has expired.
+func (s *WsServer) muted(user string) (mute, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	m, ok := s.mutes[user]
+	if ok && time.Now().After(m.until) {
+		delete(s.mutes, user)
+		return m, false
+	}
+
+	return m, ok
+}
+
+// ban stores the ban and disconnects any peers it applies to. `addr` is the remote
+// address of the admin creating the ban.
+func (s *WsServer) ban(b *common.Ban, addr string) error {
+	if err := s.db.CreateBan(b); err != nil {
+		return err
+	}
+	log.Infof("BAN %s `%s` by `%s`: %s", b.Kind, b.Value, b.CreatedBy, b.Reason)
+	s.audit(common.AUDIT_BAN, b.CreatedBy, b.Value, addr, fmt.Sprintf("%s ban %d: %s", b.Kind, b.Id, b.Reason))
+
+	reason := "banned: " + b.Reason
+	if b.Kind == common.BAN_USER {
+		s.kick(b.Value, reason)
+		return nil
+	}
+
+	prefix := netip.MustParsePrefix(b.Value)
+	s.disconnectWhere(reason, func(p *Peer) bool {
+		ip, ok := addrIP(p.conn.RemoteAddr().String())
+		return ok && prefix.Contains(ip)
+	})
+
+	return nil
+}
+
+// checkBan returns the active ban applying to the user or request address, if any.
+func (s *WsServer) checkBan(user string, r *http.Request) *common.Ban {
+	ip, _ := addrIP(r.RemoteAddr)
+	b, err := s.db.FindBan(user, ip)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if b != nil {
+		log.Warnf("REJECT banned user `%s` from %v (ban %d)", user, r.RemoteAddr, b.Id)
+	}
+
+	return b
+}
+
+func (s *WsServer) notifyUser(user string, format string, args ...any) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for p := range s.peers {
+		if p.user == user {
+			p.notify(format, args...)
+		}
+	}
+}
+
+// addrIP parses the IP address from a `host:port` string. Unix socket addresses have
+// no IP and return false.
+func addrIP(addr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap(), true
+}
+
+func isIPOrPrefix(s string) bool {
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(s)
+	return err == nil
+}
+
+func banMessage(b *common.Ban) string {
+	msg := "banned: " + b.Reason
+	if b.Expires != nil {
+		msg += " (until " + b.Expires.Format(time.RFC3339) + ")"
+	}
+	return msg
+}
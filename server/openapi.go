@@ -0,0 +1,28 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openApiSpec is the OpenAPI document for every route in registerApi. It is maintained
+// by hand, openapi_test.go fails when a registered endpoint is missing from it.
+//
+//go:embed openapi.json
+var openApiSpec []byte
+
+//go:embed apidocs.html
+var apiDocsPage []byte
+
+func apiOpenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openApiSpec)
+}
+
+// apiDocs serves a reference page which renders the OpenAPI document in the browser.
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(apiDocsPage)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type openApiOperation struct {
+	OperationId   string                `json:"operationId"`
+	Security      []map[string][]string `json:"security"`
+	AdminListener bool                  `json:"x-admin-listener"`
+	RequireAdmin  bool                  `json:"x-require-admin"`
+	Responses     map[string]any        `json:"responses"`
+}
+
+func loadSpec(t *testing.T) map[string]any {
+	t.Helper()
+
+	var spec map[string]any
+	if err := json.Unmarshal(openApiSpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	if v, _ := spec["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		t.Fatalf("openapi.json has version %q, want 3.x", v)
+	}
+
+	return spec
+}
+
+func specOperation(t *testing.T, spec map[string]any, path string, method string) (*openApiOperation, bool) {
+	t.Helper()
+
+	paths, _ := spec["paths"].(map[string]any)
+	item, _ := paths[path].(map[string]any)
+	raw, ok := item[strings.ToLower(method)]
+	if !ok {
+		return nil, false
+	}
+
+	b, _ := json.Marshal(raw)
+	var op openApiOperation
+	if err := json.Unmarshal(b, &op); err != nil {
+		t.Fatalf("%s %s: invalid operation: %v", method, path, err)
+	}
+	return &op, true
+}
+
+func TestOpenApiDescribesEveryEndpoint(t *testing.T) {
+	spec := loadSpec(t)
+	s := &WsServer{}
+
+	for _, e := range s.endpoints() {
+		op, ok := specOperation(t, spec, e.route, e.method)
+		if !ok {
+			t.Errorf("%s %s%s is registered but missing from openapi.json", e.method, apiPrefix, e.route)
+			continue
+		}
+
+		if len(op.Responses) == 0 {
+			t.Errorf("%s %s: no responses documented", e.method, e.route)
+		}
+		if op.OperationId == "" {
+			t.Errorf("%s %s: missing operationId", e.method, e.route)
+		}
+		if op.AdminListener != e.admin {
+			t.Errorf("%s %s: x-admin-listener is %v, want %v", e.method, e.route, op.AdminListener, e.admin)
+		}
+		if op.RequireAdmin != e.requireAdmin {
+			t.Errorf("%s %s: x-require-admin is %v, want %v", e.method, e.route, op.RequireAdmin, e.requireAdmin)
+		}
+		if e.protected && !hasScheme(op.Security, "bearerAuth") {
+			t.Errorf("%s %s: protected endpoint does not list bearerAuth security", e.method, e.route)
+		}
+	}
+}
+
+func TestOpenApiHasNoUnknownOperations(t *testing.T) {
+	spec := loadSpec(t)
+	s := &WsServer{}
+
+	registered := make(map[string]bool)
+	for _, e := range s.endpoints() {
+		registered[strings.ToLower(e.method)+" "+e.route] = true
+	}
+
+	paths, _ := spec["paths"].(map[string]any)
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			if method == "parameters" {
+				continue
+			}
+			if !registered[method+" "+path] {
+				t.Errorf("openapi.json describes %s %s which is not registered", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenApiRefsResolve(t *testing.T) {
+	spec := loadSpec(t)
+
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				if !resolveRef(spec, ref) {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(spec)
+}
+
+func hasScheme(security []map[string][]string, name string) bool {
+	for _, s := range security {
+		if _, ok := s[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveRef(spec map[string]any, ref string) bool {
+	if !strings.HasPrefix(ref, "#/") {
+		return false
+	}
+
+	var cur any = spec
+	for _, key := range strings.Split(ref[2:], "/") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return false
+		}
+		if cur, ok = m[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// originList checks request origins against a list of allowed values. Entries may
+// contain `*` wildcards (e.g. `https://*.example.com` or `http://localhost:*`), and a
+// single `*` entry allows every origin.
+type originList struct {
+	allowAll bool
+	patterns []string
+}
+
+// defaultOrigins allows localhost on the ports of the TCP listen addresses, or on the
+// server port when none are configured.
+func defaultOrigins(cfg Config) []string {
+	var ports []string
+	for _, addr := range cfg.Listen {
+		network, address, err := parseListenAddr(addr)
+		if err != nil || network != "tcp" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(address); err == nil && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	if len(cfg.Listen) == 0 {
+		ports = append(ports, strconv.Itoa(int(cfg.Port)))
+	}
+
+	var origins []string
+	for _, port := range ports {
+		for _, host := range []string{"localhost", "127.0.0.1", "[::1]"} {
+			origins = append(origins, fmt.Sprintf("http*://%s:%s", host, port))
+		}
+	}
+	// used for gui testing
+	return append(origins, "https://websocketking.com")
+}
+
+func newOriginList(patterns []string) *originList {
+	o := &originList{}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(p), "/"))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			o.allowAll = true
+		}
+		o.patterns = append(o.patterns, p)
+	}
+
+	if o.allowAll {
+		log.Warn("all origins are allowed, this should only be used for development")
+	}
+	return o
+}
+
+func (o *originList) Allowed(origin string) bool {
+	if o.allowAll {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+
+	origin = strings.ToLower(origin)
+	for _, p := range o.patterns {
+		if matchWildcard(p, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchWildcard reports whether `s` matches `pattern`, where `*` matches any sequence
+// of characters and everything else is literal.
+func matchWildcard(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
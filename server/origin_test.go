@@ -0,0 +1,35 @@
+package server
+
+import "testing"
+
+func TestDefaultOriginsFollowListenPorts(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		allowed []string
+		denied  []string
+	}{
+		{
+			cfg:     Config{Port: 3000},
+			allowed: []string{"http://localhost:3000", "https://[::1]:3000"},
+			denied:  []string{"http://localhost:8080", "http://example.com:3000"},
+		},
+		{
+			cfg:     Config{Port: 3000, Listen: []string{"127.0.0.1:3911", "unix:/tmp/hello-go.sock"}},
+			allowed: []string{"http://127.0.0.1:3911", "http://localhost:3911"},
+			denied:  []string{"http://localhost:3000"},
+		},
+	}
+	for _, tt := range tests {
+		origins := newOriginList(defaultOrigins(tt.cfg))
+		for _, o := range tt.allowed {
+			if !origins.Allowed(o) {
+				t.Errorf("%+v: origin %s is denied", tt.cfg, o)
+			}
+		}
+		for _, o := range tt.denied {
+			if origins.Allowed(o) {
+				t.Errorf("%+v: origin %s is allowed", tt.cfg, o)
+			}
+		}
+	}
+}
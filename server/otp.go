@@ -11,10 +11,11 @@ const validDuration = time.Second * 5
 
 type Otp struct {
 	value   string
+	user    string
 	created time.Time
 }
 
-func NewOtp() *Otp {
+func NewOtp(user string) *Otp {
 	value, err := gonanoid.New()
 	if err != nil {
 		log.Fatalf("error generating OTP: %v", err)
@@ -22,6 +23,7 @@ func NewOtp() *Otp {
 
 	return &Otp{
 		value:   value,
+		user:    user,
 		created: time.Now(),
 	}
 }
@@ -1,37 +1,249 @@
 package server
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"hello-go/common"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/websocket"
+	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
+// writeQueueSize is the number of packets buffered for a peer before new packets are
+// dropped.
+const writeQueueSize = 64
+
+// writeTimeout bounds writing one packet, so a stalled client cannot hold its write
+// loop forever.
+const writeTimeout = 10 * time.Second
+
 type Peer struct {
-	conn *websocket.Conn
-	tx   chan common.Packet
+	id         string
+	user       string
+	connected  time.Time
+	lastActive atomic.Int64
+	// lastInput is the time of the last packet sent by the client, unlike lastActive
+	// it ignores pongs
+	lastInput  atomic.Int64
+	rtt        atomic.Int64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+	logger     *log.Logger
+	conn       *websocket.Conn
+	rw         *meteredConn
+	tx         chan common.Packet
+	done       chan struct{}
+	once       sync.Once
+}
+
+// PeerInfo is the API representation of a connected peer.
+type PeerInfo struct {
+	Id         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Connected  time.Time `json:"connected_since"`
+	LastActive time.Time `json:"last_active"`
+	LatencyMs  float64   `json:"latency_ms"`
+	QueueDepth int       `json:"queue_depth"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
 }
 
-func NewPeer(conn *websocket.Conn) *Peer {
-	return &Peer{
-		conn: conn,
-		tx:   make(chan common.Packet),
+func NewPeer(conn *websocket.Conn, user string, s *WsServer) *Peer {
+	id, err := gonanoid.New(12)
+	if err != nil {
+		log.Fatalf("error generating peer id: %v", err)
 	}
+
+	p := &Peer{
+		id:        id,
+		user:      user,
+		connected: time.Now(),
+		logger:    log.With("peer", id, "user", user, "remote", conn.RemoteAddr().String()),
+		conn:      conn,
+		rw:        &meteredConn{Conn: conn, m: s.metrics},
+		tx:        make(chan common.Packet, writeQueueSize),
+		done:      make(chan struct{}),
+	}
+	p.touch()
+	p.lastInput.Store(time.Now().UnixNano())
+	conn.SetPongHandler(p.pong)
+
+	return p
 }
 
 func (p *Peer) Name() string {
-	return p.conn.RemoteAddr().String()
+	return p.user + "@" + p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) Info() PeerInfo {
+	return PeerInfo{
+		Id:         p.id,
+		User:       p.user,
+		RemoteAddr: p.conn.RemoteAddr().String(),
+		Connected:  p.connected,
+		LastActive: time.Unix(0, p.lastActive.Load()),
+		LatencyMs:  float64(p.rtt.Load()) / float64(time.Millisecond),
+		QueueDepth: len(p.tx),
+		PacketsIn:  p.packetsIn.Load(),
+		PacketsOut: p.packetsOut.Load(),
+	}
+}
+
+func (p *Peer) touch() {
+	p.lastActive.Store(time.Now().UnixNano())
+}
+
+func (p *Peer) lastInputTime() time.Time {
+	return time.Unix(0, p.lastInput.Load())
+}
+
+// ping sends a websocket ping carrying the current time, which is echoed back in the
+// pong to measure round trip latency.
+func (p *Peer) ping() {
+	data := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	deadline := time.Now().Add(time.Second * 5)
+	if err := p.conn.WriteControl(websocket.PingMessage, data, deadline); err != nil {
+		p.logger.Debug("ping failed", "err", err)
+	}
+}
+
+func (p *Peer) pong(data string) error {
+	p.touch()
+	if len(data) == 8 {
+		sent := int64(binary.BigEndian.Uint64([]byte(data)))
+		p.rtt.Store(time.Now().UnixNano() - sent)
+	}
+
+	return nil
+}
+
+// send queues a packet to be written to the peer, returning false if the peer is
+// closed or its queue is full.
+func (p *Peer) send(packet common.Packet) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	select {
+	case p.tx <- packet:
+		return true
+	default:
+		p.logger.Warn("write queue full, dropping packet", "type", packetType(packet))
+		return false
+	}
 }
 
-func (p *Peer) recv() {
+// notify sends a notice to the peer.
+func (p *Peer) notify(format string, args ...any) {
+	p.send(&common.RawPacket{
+		Type:    common.PACKET_NOTICE,
+		Payload: []byte(fmt.Sprintf(format, args...)),
+	})
+}
+
+// disconnect notifies the peer with the reason and closes the connection once every
+// queued packet has been written. A peer whose write queue is full is closed at once.
+func (p *Peer) disconnect(reason string) {
+	p.notify("%s", reason)
+	if !p.send(&closePacket{code: websocket.ClosePolicyViolation, reason: reason}) {
+		p.close()
+	}
+}
+
+// close stops the write loop and closes the connection. It is safe to call more than
+// once.
+func (p *Peer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+func (p *Peer) writeLoop() {
 	for {
-		p, err := common.ReadPacket(p.conn)
-		if err != nil && err != common.ErrDisconnected {
-			log.Error(err)
+		select {
+		case packet := <-p.tx:
+			if c, ok := packet.(*closePacket); ok {
+				msg := websocket.FormatCloseMessage(c.code, c.reason)
+				p.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				p.close()
+				return
+			}
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := common.WritePacket(p.rw, packet); err != nil {
+				if !common.IsConnClosedErr(err) {
+					p.logger.Error("write failed", "err", err)
+				}
+				p.close()
+				return
+			}
+			p.rw.m.packetsOut.Inc(packetType(packet))
+			p.packetsOut.Add(1)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Peer) recv(handle func(*Peer, *common.RawPacket)) {
+	for {
+		packet, err := common.ReadPacket(p.rw)
+		if err != nil && !errors.Is(err, common.ErrDisconnected) {
+			p.logger.Error("read failed", "err", err)
 			break
 		}
-		if p == nil {
+		if packet == nil {
 			break
 		}
+		p.rw.m.packetsIn.Inc(packet.Type)
+		p.packetsIn.Add(1)
+		p.touch()
+		p.lastInput.Store(time.Now().UnixNano())
+		handle(p, packet)
+	}
+}
+
+// closePacket is queued to close the connection after earlier packets are written.
+type closePacket struct {
+	code   int
+	reason string
+}
+
+func (c *closePacket) EncodePacket() []byte {
+	return nil
+}
+
+func packetType(p common.Packet) string {
+	if raw, ok := p.(*common.RawPacket); ok {
+		return raw.Type
+	}
+	return "unknown"
+}
+
+// meteredConn counts the bytes read from and written to a websocket connection.
+type meteredConn struct {
+	*websocket.Conn
+	m *metrics
+}
+
+func (c *meteredConn) ReadMessage() (int, []byte, error) {
+	ty, data, err := c.Conn.ReadMessage()
+	c.m.bytesIn.Add(uint64(len(data)))
+	return ty, data, err
+}
+
+func (c *meteredConn) WriteMessage(ty int, data []byte) error {
+	err := c.Conn.WriteMessage(ty, data)
+	if err == nil {
+		c.m.bytesOut.Add(uint64(len(data)))
 	}
+	return err
 }
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"cmp"
+	"hello-go/common"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// presenceCheckInterval is how often idle users are checked to mark them away.
+const presenceCheckInterval = 15 * time.Second
+
+// presenceState is the presence of a connected user, shared by all of their sessions.
+type presenceState struct {
+	// status is the last published status
+	status string
+	// away is set by the user and overrides their activity
+	away    bool
+	message string
+}
+
+// presenceOf returns the status of a connected user and their last activity. They are
+// away when they said so, or when every session has been idle for AwayAfter. It must
+// be called with the server lock held.
+func (s *WsServer) presenceOf(user string, st *presenceState) (string, time.Time) {
+	var last time.Time
+	for p := range s.peers {
+		if t := p.lastInputTime(); p.user == user && t.After(last) {
+			last = t
+		}
+	}
+
+	if st.away || time.Since(last) >= s.cfg.AwayAfter {
+		return common.PRESENCE_AWAY, last
+	}
+	return common.PRESENCE_ONLINE, last
+}
+
+// refreshPresence publishes the presence of a connected user if their status changed,
+// or always when `changed` is set.
+func (s *WsServer) refreshPresence(user string, changed bool) {
+	s.Lock()
+	st, ok := s.presence[user]
+	if !ok {
+		s.Unlock()
+		return
+	}
+	status, _ := s.presenceOf(user, st)
+	changed = changed || status != st.status
+	st.status = status
+	msg := st.message
+	s.Unlock()
+
+	if changed {
+		s.publish(common.Event{Type: common.EVENT_PRESENCE, User: user, Status: status, Text: msg})
+	}
+}
+
+// active brings a user back from being idle when one of their sessions sends a packet.
+func (s *WsServer) active(p *Peer) {
+	s.RLock()
+	st := s.presence[p.user]
+	idle := st != nil && st.status == common.PRESENCE_AWAY && !st.away
+	s.RUnlock()
+
+	if idle {
+		s.refreshPresence(p.user, false)
+	}
+}
+
+// watchPresence periodically marks idle users as away.
+func (s *WsServer) watchPresence() {
+	for {
+		time.Sleep(presenceCheckInterval)
+
+		s.RLock()
+		users := make([]string, 0, len(s.presence))
+		for user := range s.presence {
+			users = append(users, user)
+		}
+		s.RUnlock()
+
+		for _, user := range users {
+			s.refreshPresence(user, false)
+		}
+	}
+}
+
+// setStatus applies a status update from a user to all of their sessions.
+func (s *WsServer) setStatus(user string, u common.StatusUpdate) error {
+	var v validation
+	v.check(
+		u.Status == "" || u.Status == common.PRESENCE_ONLINE || u.Status == common.PRESENCE_AWAY,
+		"status", "status must be `%s` or `%s`", common.PRESENCE_ONLINE, common.PRESENCE_AWAY,
+	)
+	if u.Message != nil {
+		msg := strings.TrimSpace(*u.Message)
+		v.check(len(msg) <= common.MAX_STATUS_LEN, "message", "message must be at most %d bytes", common.MAX_STATUS_LEN)
+		u.Message = &msg
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	if u.Message != nil {
+		if err := s.db.SetStatusMessage(user, *u.Message); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	if st := s.presence[user]; st != nil {
+		if u.Status != "" {
+			st.away = u.Status == common.PRESENCE_AWAY
+		}
+		if u.Message != nil {
+			st.message = *u.Message
+		}
+	}
+	s.Unlock()
+
+	s.refreshPresence(user, u.Message != nil)
+	return nil
+}
+
+// onlineUsers returns the presence of every connected user, sorted by name.
+func (s *WsServer) onlineUsers() []common.Presence {
+	s.RLock()
+	defer s.RUnlock()
+
+	users := make([]common.Presence, 0, len(s.presence))
+	for user, st := range s.presence {
+		_, last := s.presenceOf(user, st)
+		users = append(users, common.Presence{
+			User:     user,
+			Status:   st.status,
+			Message:  st.message,
+			LastSeen: &last,
+			Sessions: s.sessions(user),
+		})
+	}
+	slices.SortFunc(users, func(a, b common.Presence) int {
+		return cmp.Compare(a.User, b.User)
+	})
+
+	return users
+}
+
+// apiGetPresence returns the presence of every user.
+func (s *WsServer) apiGetPresence(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetPresence()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	online := s.onlineUsers()
+	for i, u := range users {
+		if j, ok := slices.BinarySearchFunc(online, u.User, func(p common.Presence, user string) int {
+			return cmp.Compare(p.User, user)
+		}); ok {
+			users[i] = online[j]
+		}
+	}
+
+	writeJSON(w, http.StatusOK, obj{"presence": users})
+}
+
+// markSeen records when a user's last session ended.
+func (s *WsServer) markSeen(user string) {
+	if err := s.db.SetLastSeen(user, time.Now()); err != nil {
+		log.Error("failed to store last seen time", "err", err, "user", user)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"hello-go/common"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// queuePruneInterval is how often expired queued messages are removed.
+const queuePruneInterval = time.Hour
+
+// deliveryFor returns whether a direct message to `to` is delivered live or queued
+// because they have no session.
+func (s *WsServer) deliveryFor(to string) string {
+	s.RLock()
+	defer s.RUnlock()
+	if s.sessions(to) > 0 {
+		return common.DELIVERY_LIVE
+	}
+	return common.DELIVERY_QUEUED
+}
+
+// checkQueueLimit fails if the queue of `to` is full. It must be called with queueMu
+// held until the message is queued, so concurrent senders cannot exceed the limit.
+func (s *WsServer) checkQueueLimit(to string) error {
+	n, err := s.db.CountQueued(to)
+	if err != nil {
+		return err
+	}
+	if n >= s.cfg.OfflineQueueLimit {
+		return newApiError(
+			http.StatusTooManyRequests, CODE_QUEUE_FULL, "`%s` is offline and has too many queued messages", to,
+		)
+	}
+	return nil
+}
+
+// claimQueued removes the queued direct messages of a user and returns them, so each is
+// delivered to one session only.
+func (s *WsServer) claimQueued(user string) ([]common.Message, error) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	return s.db.ClaimQueued(user)
+}
+
+// deliverQueued writes the queued direct messages of a user to their new session. It
+// must be called before the write loop of the peer starts, so queued messages arrive
+// before any live event. Messages which could not be written are queued again.
+func (s *WsServer) deliverQueued(p *Peer) {
+	messages, err := s.claimQueued(p.user)
+	if err != nil {
+		p.logger.Error("failed to load queued messages", "err", err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	for i, m := range messages {
+		err := common.WritePacket(p.rw, common.NewJSONPacket(common.PACKET_EVENT, common.Event{
+			Type:      common.EVENT_MESSAGE,
+			Time:      m.Time,
+			User:      m.From,
+			To:        m.To,
+			Text:      m.Text,
+			MessageId: m.Id,
+			ParentId:  m.ParentId,
+			Queued:    true,
+		}))
+		if err != nil {
+			p.logger.Warn("failed to deliver queued message", "err", err, "message", m.Id)
+			if err := s.db.RequeueMessages(p.user, messages[i:], time.Now().Add(s.cfg.OfflineQueueTTL)); err != nil {
+				p.logger.Error("failed to queue undelivered messages", "err", err)
+			}
+			return
+		}
+		p.rw.m.packetsOut.Inc(common.PACKET_EVENT)
+		p.packetsOut.Add(1)
+	}
+	p.logger.Info("delivered queued messages", "count", len(messages))
+}
+
+// pruneQueue periodically removes expired queued messages.
+func (s *WsServer) pruneQueue() {
+	for {
+		n, err := s.db.PruneQueue()
+		if err != nil {
+			log.Error("failed to prune offline queue", "err", err)
+		} else if n > 0 {
+			log.Info("pruned expired queued messages", "count", n, "ttl", s.cfg.OfflineQueueTTL)
+		}
+
+		time.Sleep(queuePruneInterval)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"hello-go/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sendDirect(t *testing.T, s *WsServer, from string, to string, text string) (*common.Message, error) {
+	t.Helper()
+	m, _, err := s.postText(from, common.Text{To: to, Text: text})
+	return m, err
+}
+
+func TestOfflineQueueIsLimitedAndClaimedOnce(t *testing.T) {
+	s := newTestServer(t, Config{OfflineQueueLimit: 2})
+
+	var queued []int64
+	for _, text := range []string{"one", "two"} {
+		m, err := sendDirect(t, s, "alice", "bob", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Delivery != common.DELIVERY_QUEUED {
+			t.Errorf("delivery is %q, want queued", m.Delivery)
+		}
+		queued = append(queued, m.Id)
+	}
+	var e *apiError
+	if _, err := sendDirect(t, s, "alice", "bob", "three"); !errors.As(err, &e) || e.Code != CODE_QUEUE_FULL {
+		t.Errorf("sending to a full queue returned %v, want %s", err, CODE_QUEUE_FULL)
+	}
+
+	// sessions connecting at the same time share the queue
+	var mu sync.Mutex
+	var claimed []int64
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			messages, err := s.claimQueued("bob")
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			for _, m := range messages {
+				claimed = append(claimed, m.Id)
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(claimed) != len(queued) {
+		t.Errorf("claimed messages %v, want %v once", claimed, queued)
+	}
+}
+
+func TestOfflineQueueExpires(t *testing.T) {
+	s := newTestServer(t, Config{OfflineQueueLimit: 1, OfflineQueueTTL: time.Nanosecond})
+
+	for range 2 {
+		// expired messages do not count towards the limit
+		if _, err := sendDirect(t, s, "alice", "bob", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages, _ := s.claimQueued("bob"); len(messages) != 0 {
+		t.Errorf("claimed %d expired messages", len(messages))
+	}
+	if n, err := s.db.PruneQueue(); err != nil || n != 2 {
+		t.Errorf("pruned %d messages (%v), want 2", n, err)
+	}
+	if history, _ := s.db.GetMessages(common.MessageFilter{Viewer: "bob"}); len(history) != 2 {
+		t.Errorf("history has %d messages, want expired messages kept", len(history))
+	}
+}
+
+func TestQueuedMessageToNewSessionIsDeliveredOnce(t *testing.T) {
+	s := newTestServer(t, Config{OfflineQueueLimit: 1})
+	// bob connected after the message was queued, but claimed his queue before it was
+	// stored
+	bob := testPeer(s, "bob")
+	m := &common.Message{From: "alice", To: "bob", Text: "hello", Delivery: common.DELIVERY_QUEUED}
+	if err := s.deliverMessage(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bob.tx) != 1 {
+		t.Errorf("bob received %d packets, want the message live", len(bob.tx))
+	}
+	if m.Delivery != common.DELIVERY_LIVE {
+		t.Errorf("delivery is %q, want live", m.Delivery)
+	}
+	if messages, _ := s.claimQueued("bob"); len(messages) != 0 {
+		t.Errorf("message delivered live is still queued")
+	}
+}
+
+func TestConcurrentSendersRespectQueueLimit(t *testing.T) {
+	s := newTestServer(t, Config{OfflineQueueLimit: 2, OfflineQueueTTL: time.Hour})
+
+	// senders waiting for the queue lock must not have checked the limit already
+	s.queueMu.Lock()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendDirect(t, s, "alice", "bob", "hello")
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.queueMu.Unlock()
+	wg.Wait()
+
+	if n, _ := s.db.CountQueued("bob"); n != 2 {
+		t.Errorf("queued %d messages, want the limit of 2", n)
+	}
+}
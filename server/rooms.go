@@ -0,0 +1,136 @@
+package server
+
+import (
+	"cmp"
+	"hello-go/common"
+	"slices"
+)
+
+// RoomInfo is the API representation of a room.
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Joined  bool   `json:"joined"`
+}
+
+func (s *WsServer) loadRooms() error {
+	members, err := s.db.GetRoomMembers()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for room, users := range members {
+		s.rooms[room] = make(map[string]struct{}, len(users))
+		for _, u := range users {
+			s.rooms[room][u] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// isMember must be called with the server lock held.
+func (s *WsServer) isMember(room string, user string) bool {
+	_, ok := s.rooms[room][user]
+	return ok
+}
+
+// joinRoom adds `user` to a room and announces it to the members.
+func (s *WsServer) joinRoom(user string, room string) (string, error) {
+	room, err := common.NormalizeRoom(room)
+	if err != nil {
+		return "", errInvalidField("room", "%v", err)
+	}
+
+	ok, err := s.db.JoinRoom(room, user)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return room, errConflict("already a member of #%s", room)
+	}
+
+	s.Lock()
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[string]struct{})
+	}
+	s.rooms[room][user] = struct{}{}
+	s.Unlock()
+
+	s.publish(common.Event{Type: common.EVENT_JOIN, User: user, Room: room})
+	return room, nil
+}
+
+// leaveRoom removes `user` from a room and announces it to the remaining members.
+func (s *WsServer) leaveRoom(user string, room string) (string, error) {
+	room, err := common.NormalizeRoom(room)
+	if err != nil {
+		return "", errInvalidField("room", "%v", err)
+	}
+
+	ok, err := s.db.LeaveRoom(room, user)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return room, errNotFound("not a member of #%s", room)
+	}
+
+	s.Lock()
+	s.dropMember(room, user)
+	s.Unlock()
+
+	s.publish(common.Event{Type: common.EVENT_LEAVE, User: user, Room: room})
+	return room, nil
+}
+
+// sharesRoom reports whether two users are members of a common room. It must be
+// called with the server lock held.
+func (s *WsServer) sharesRoom(a string, b string) bool {
+	for _, members := range s.rooms {
+		_, okA := members[a]
+		_, okB := members[b]
+		if okA && okB {
+			return true
+		}
+	}
+	return false
+}
+
+// dropMember removes a user from the in-memory room, deleting it once empty. It must
+// be called with the server lock held.
+func (s *WsServer) dropMember(room string, user string) {
+	delete(s.rooms[room], user)
+	if len(s.rooms[room]) == 0 {
+		delete(s.rooms, room)
+	}
+}
+
+// forgetUser removes a deleted user from every room, the database rows are removed by
+// DeleteUser.
+func (s *WsServer) forgetUser(user string) {
+	s.Lock()
+	defer s.Unlock()
+	for room := range s.rooms {
+		s.dropMember(room, user)
+	}
+}
+
+// roomList returns every room with members, sorted by name.
+func (s *WsServer) roomList(user string) []RoomInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	rooms := make([]RoomInfo, 0, len(s.rooms))
+	for name, members := range s.rooms {
+		_, joined := members[user]
+		rooms = append(rooms, RoomInfo{Name: name, Members: len(members), Joined: joined})
+	}
+	slices.SortFunc(rooms, func(a, b RoomInfo) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return rooms
+}
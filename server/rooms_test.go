@@ -0,0 +1,52 @@
+package server
+
+import (
+	"hello-go/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeletedUserLeavesRoomsAndReactions(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := s.joinRoom(user, "dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, _, err := s.postText("alice", common.Text{Room: "dev", Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.db.React(m.Id, "bob", "👍", false); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/users/bob", nil)
+	r.SetPathValue("userId", "bob")
+	w := httptest.NewRecorder()
+	s.apiDeleteUser(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleting bob returned %d: %s", w.Code, w.Body)
+	}
+
+	// membership is reloaded from the database on restart
+	s.rooms = make(RoomMap)
+	if err := s.loadRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if s.isMember("dev", "bob") || !s.isMember("dev", "alice") {
+		t.Errorf("members of #dev are %v, want only alice", s.rooms["dev"])
+	}
+
+	if history, _ := s.db.GetMessages(common.MessageFilter{Viewer: "alice", Room: "dev"}); len(history) != 1 || len(history[0].Reactions) != 0 {
+		t.Errorf("reactions of the deleted user are still counted: %v", history)
+	}
+
+	if err := s.db.CreateUser("bob", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := s.db.GetMessages(common.MessageFilter{Viewer: "bob", Room: "dev"}); len(history) != 0 {
+		t.Errorf("a new bob can read %d messages of the deleted one", len(history))
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"hello-go/common"
+	"net/http"
+)
+
+// route dispatches a packet received from a peer by its type.
+func (s *WsServer) route(p *Peer, packet *common.RawPacket) {
+	s.active(p)
+
+	// ephemeral signals are only relayed to connected peers, they are never stored or
+	// published as events
+	if common.IsSignal(packet.Type) {
+		s.handleSignal(p, packet)
+		return
+	}
+
+	switch packet.Type {
+	case common.PACKET_TEXT:
+		s.handleText(p, packet)
+	case common.PACKET_COMMAND:
+		s.handleCommand(p, packet)
+	case common.PACKET_JOIN:
+		s.handleRoom(p, packet, s.joinRoom)
+	case common.PACKET_LEAVE:
+		s.handleRoom(p, packet, s.leaveRoom)
+	case common.PACKET_EDIT:
+		handlePayload(p, packet, func(e common.Edit) error { return s.editMessage(p.user, e) })
+	case common.PACKET_DELETE:
+		handlePayload(p, packet, func(d common.Delete) error {
+			return s.deleteMessage(p.user, p.conn.RemoteAddr().String(), d)
+		})
+	case common.PACKET_REACT:
+		handlePayload(p, packet, func(r common.Reaction) error { return s.react(p.user, r) })
+	case common.PACKET_THREAD:
+		s.handleThread(p, packet)
+	case common.PACKET_STATUS:
+		s.handleStatus(p, packet)
+	case common.PACKET_WHO:
+		p.send(common.NewJSONPacket(common.PACKET_WHO, s.onlineUsers()))
+	default:
+		p.logger.Warn("unhandled packet", "type", packet.Type)
+	}
+}
+
+// handleText sends a message, acknowledging it when the client assigned an id.
+func (s *WsServer) handleText(p *Peer, packet *common.RawPacket) {
+	t, err := decodeText(packet.Payload)
+	var m *common.Message
+	var duplicate bool
+	if err == nil {
+		m, duplicate, err = s.postText(p.user, t)
+	}
+
+	var e *apiError
+	switch {
+	case t.Id != "" && err == nil:
+		p.send(common.NewJSONPacket(common.PACKET_ACK, common.Ack{Id: t.Id, MessageId: m.Id, Duplicate: duplicate, Delivery: m.Delivery}))
+	case t.Id != "" && errors.As(err, &e) && e.status < http.StatusInternalServerError:
+		// rejected messages are acknowledged so the client does not resend them, unlike
+		// server errors after which resending may succeed
+		p.send(common.NewJSONPacket(common.PACKET_ACK, common.Ack{Id: t.Id, Error: err.Error()}))
+	case err != nil:
+		p.notify("message not sent: %v", err)
+	}
+}
+
+// handlePayload decodes a JSON payload and applies `action` to it, notifying the peer
+// if either fails.
+func handlePayload[T any](p *Peer, packet *common.RawPacket, action func(T) error) {
+	var v T
+	err := packet.Decode(&v)
+	if err == nil {
+		err = action(v)
+	}
+	if err != nil {
+		p.notify("%s failed: %v", packet.Type, err)
+	}
+}
+
+// handleRoom joins or leaves the room named in the packet payload.
+func (s *WsServer) handleRoom(p *Peer, packet *common.RawPacket, action func(string, string) (string, error)) {
+	if _, err := action(p.user, string(packet.Payload)); err != nil {
+		p.notify("%s failed: %v", packet.Type, err)
+	}
+}
+
+func (s *WsServer) handleStatus(p *Peer, packet *common.RawPacket) {
+	var u common.StatusUpdate
+	err := packet.Decode(&u)
+	if err == nil {
+		err = s.setStatus(p.user, u)
+	}
+	if err != nil {
+		p.notify("status not changed: %v", err)
+	}
+}
+
+func (s *WsServer) handleSignal(p *Peer, packet *common.RawPacket) {
+	var sig common.Signal
+	err := packet.Decode(&sig)
+	if err == nil {
+		sig, err = s.checkSignal(p.user, packet.Type, sig)
+	}
+	if err != nil {
+		p.notify("%s not sent: %v", packet.Type, err)
+		return
+	}
+
+	switch packet.Type {
+	case common.PACKET_TYPING:
+		s.signals.startTyping(p, sig)
+	case common.PACKET_TYPING_STOP:
+		s.signals.stopTyping(keyOf(sig), p)
+	case common.PACKET_READ:
+		s.signals.markRead(p, sig)
+	}
+}
+
+func (s *WsServer) handleCommand(p *Peer, packet *common.RawPacket) {
+	var c common.Command
+	if err := packet.Decode(&c); err != nil {
+		p.notify("invalid command: %v", err)
+		return
+	}
+	if !s.db.IsAdmin(p.user) {
+		p.logger.Warn("REJECT command from non-admin", "action", c.Action)
+		p.notify("permission denied: `%s` requires admin", c.Action)
+		return
+	}
+
+	msg, err := s.moderate(p.user, p.conn.RemoteAddr().String(), c)
+	if err != nil {
+		p.notify("%s failed: %v", c.Action, err)
+		return
+	}
+	p.notify("%s", msg)
+}
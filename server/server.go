@@ -1,9 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"hello-go/common"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,47 +18,184 @@ import (
 type (
 	PeerMap map[*Peer]struct{}
 	OtpMap  map[string]*Otp
+	MuteMap map[string]mute
+	// RoomMap holds the members of each room, mirroring the current memberships in
+	// the database.
+	RoomMap map[string]map[string]struct{}
+	// PresenceMap holds the presence of each connected user.
+	PresenceMap map[string]*presenceState
 )
 
+// Config holds the options used to run a WsServer.
+type Config struct {
+	Port uint16
+	// Listen is a list of addresses to serve on, see parseListenAddr. Defaults to all
+	// interfaces on Port when empty.
+	Listen []string
+	// AdminListen is an optional list of addresses serving the management API and
+	// debugging endpoints. When empty, management routes are served on Listen and
+	// debugging endpoints are disabled.
+	AdminListen []string
+	// TLSCert and TLSKey are paths to PEM files. TLS is enabled when both are set.
+	TLSCert string
+	TLSKey  string
+	// ClientCA is an optional path to a PEM file with CAs trusted to sign client
+	// certificates. Clients presenting a valid certificate skip password auth.
+	ClientCA string
+	// RedirectPort is an optional plain HTTP port which redirects to the TLS port.
+	RedirectPort uint16
+	// AuditRetention is how long audit log entries are kept, zero keeps them forever.
+	AuditRetention time.Duration
+	// AllowedOrigins lists the origins permitted to open a websocket or make CORS
+	// requests to the API, see originList. Defaults to localhost on the ports the server
+	// listens on when empty.
+	AllowedOrigins []string
+	// CORSMethods and CORSHeaders are returned to preflight requests, defaulting to
+	// the methods used by the API and the `Authorization`, `Content-Type` and
+	// `X-Request-ID` headers.
+	CORSMethods []string
+	CORSHeaders []string
+	// CORSCredentials allows browsers to send cookies and HTTP auth cross-origin.
+	CORSCredentials bool
+	// CORSMaxAge is how long browsers may cache a preflight response, defaults to 10m.
+	CORSMaxAge time.Duration
+	// WebhookAttempts is how many times a webhook delivery is tried before it is moved
+	// to the dead-letter table, defaults to 5.
+	WebhookAttempts int
+	// WebhookBackoff is the delay before the first retry of a webhook delivery, which
+	// doubles after each attempt. Defaults to 2s.
+	WebhookBackoff time.Duration
+	// AwayAfter is how long every session of a user must be idle before they are shown
+	// as away, defaults to 5m.
+	AwayAfter time.Duration
+	// OfflineQueueLimit is the most direct messages queued for an offline user,
+	// defaults to 100.
+	OfflineQueueLimit int
+	// OfflineQueueTTL is how long direct messages stay queued for an offline user,
+	// defaults to 7 days. Expired messages remain in the message history.
+	OfflineQueueTTL time.Duration
+	// EditWindow is how long authors can edit a message after sending it, defaults
+	// to 15m.
+	EditWindow time.Duration
+}
+
+func (c *Config) UseTLS() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
 type WsServer struct {
-	port     uint16
+	cfg      Config
+	origins  *originList
+	cors     *corsPolicy
 	db       *common.Database
 	peers    PeerMap
 	otps     OtpMap
+	mutes    MuteMap
+	rooms    RoomMap
+	presence PresenceMap
+	events   *eventBus
+	webhooks *dispatcher
+	signals  *signals
+	// queueMu orders queueing direct messages against delivering the queue of a new
+	// session, so each queued message is delivered exactly once
+	queueMu  sync.Mutex
 	upgrader websocket.Upgrader
+	metrics  *metrics
+	started  time.Time
+	// addresses of the open listeners, set once by Run
+	listenAddrs []string
+	adminAddrs  []string
 	sync.RWMutex
 }
 
-func New(port uint16) *WsServer {
-	origins := map[string]struct{}{
-		fmt.Sprintf("http://localhost:%v", port): {},
-		// used for gui testing
-		"https://websocketking.com": {},
+// New creates a server from the config, failing if it is invalid.
+func New(cfg Config) (*WsServer, error) {
+	if len(cfg.AllowedOrigins) == 0 {
+		cfg.AllowedOrigins = defaultOrigins(cfg)
+	}
+	origins := newOriginList(cfg.AllowedOrigins)
+	if cfg.WebhookAttempts <= 0 {
+		cfg.WebhookAttempts = 5
+	}
+	if cfg.WebhookBackoff <= 0 {
+		cfg.WebhookBackoff = 2 * time.Second
+	}
+	if cfg.AwayAfter <= 0 {
+		cfg.AwayAfter = 5 * time.Minute
+	}
+	if cfg.OfflineQueueLimit <= 0 {
+		cfg.OfflineQueueLimit = 100
+	}
+	if cfg.OfflineQueueTTL <= 0 {
+		cfg.OfflineQueueTTL = 7 * 24 * time.Hour
+	}
+	if cfg.EditWindow <= 0 {
+		cfg.EditWindow = 15 * time.Minute
+	}
+
+	cors, err := newCORSPolicy(cfg, origins)
+	if err != nil {
+		return nil, err
 	}
 
 	return &WsServer{
-		port:  port,
-		peers: make(PeerMap),
-		otps:  make(OtpMap),
+		cfg:      cfg,
+		origins:  origins,
+		cors:     cors,
+		peers:    make(PeerMap),
+		otps:     make(OtpMap),
+		mutes:    make(MuteMap),
+		rooms:    make(RoomMap),
+		presence: make(PresenceMap),
+		events:   newEventBus(),
+		metrics:  &metrics{},
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  2048,
 			WriteBufferSize: 2048,
 			CheckOrigin: func(r *http.Request) bool {
 				o := r.Header.Get("Origin")
-				_, ok := origins[o]
-				return ok
+				if !origins.Allowed(o) {
+					log.Warnf("REJECT websocket origin `%s` from %v", o, r.RemoteAddr)
+					return false
+				}
+				return true
 			},
 		},
-	}
+	}, nil
 }
 
 func (s *WsServer) Run() error {
+	s.started = time.Now()
 	s.db = common.DbConnect()
+	s.db.OnQuery = s.metrics.dbLatency.Observe
 	defer s.db.Close()
+	if err := s.db.CheckFTS5(); err != nil {
+		log.Warnf("%v, message search is disabled", err)
+	}
+	if err := s.loadRooms(); err != nil {
+		return err
+	}
+	s.webhooks = newDispatcher(s.db, s.cfg.WebhookAttempts, s.cfg.WebhookBackoff)
+	s.signals = newSignals(s.relaySignal)
+	if err := s.loadWebhooks(); err != nil {
+		return err
+	}
+	s.webhooks.start()
+
+	public := http.NewServeMux()
+	public.Handle("GET /login", s.withMiddleware("GET /login", http.HandlerFunc(s.authOTP)))
+	public.HandleFunc("/ws", s.serveWS)
 
-	http.HandleFunc("GET /login", s.authOTP)
-	http.HandleFunc("/ws", s.serveWS)
-	s.registerApi()
+	// management routes move to their own mux when an admin listener is configured
+	admin := public
+	if len(s.cfg.AdminListen) > 0 {
+		admin = http.NewServeMux()
+		registerDebug(admin)
+		admin.Handle("GET /metrics", s.withMiddleware("GET /metrics", http.HandlerFunc(s.apiMetrics)))
+	} else {
+		public.Handle("GET /metrics", s.withMiddleware("GET /metrics", s.bearerAuth(s.requireAdmin(http.HandlerFunc(s.apiMetrics)))))
+	}
+	s.registerApi(public, admin)
 
 	// DEBUG: testing client recv
 	go func() {
@@ -63,97 +204,347 @@ func (s *WsServer) Run() error {
 		for {
 			time.Sleep(time.Second * 5)
 			s.RLock()
+			peers := make([]*Peer, 0, len(s.peers))
 			for p := range s.peers {
-				common.WritePacket(p.conn, packet)
+				peers = append(peers, p)
 			}
 			s.RUnlock()
+
+			// pings block on slow peers for up to their write deadline, so they are sent
+			// without holding the lock
+			for _, p := range peers {
+				p.send(packet)
+				p.ping()
+			}
 		}
 	}()
 
+	if s.cfg.AuditRetention > 0 {
+		go s.pruneAudit()
+	}
+	go s.watchPresence()
+	go s.pruneQueue()
+
 	// watch for expired otps
 	go func() {
 		for {
 			time.Sleep(time.Second * 5)
+			s.Lock()
 			for k, otp := range s.otps {
 				if otp.IsExpired() {
-					log.Debugf("removing expired OTP %v", k)
+					log.Debug("removing expired OTP", "otp", common.Fingerprint(k), "user", otp.user)
 					delete(s.otps, k)
 				}
 			}
+			s.Unlock()
 		}
 	}()
 
-	log.Debugf("server listening on :%v", s.port)
-	return http.ListenAndServe(fmt.Sprintf(":%v", s.port), nil)
+	addrs := s.cfg.Listen
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf(":%v", s.cfg.Port)}
+	}
+	if !s.cfg.UseTLS() {
+		log.Warn("TLS is disabled, credentials will be sent in plaintext")
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		return err
+	}
+	adminListeners, err := listenAll(s.cfg.AdminListen)
+	if err != nil {
+		closeAll(listeners)
+		return err
+	}
+
+	s.listenAddrs = listenerAddrs(listeners)
+	s.adminAddrs = listenerAddrs(adminListeners)
+
+	errs := make(chan error, len(listeners)+len(adminListeners))
+	srv := &http.Server{Handler: public, TLSConfig: tlsConfig}
+	s.serve(srv, listeners, errs)
+	defer srv.Close()
+	if admin != public {
+		adminSrv := &http.Server{Handler: admin, TLSConfig: tlsConfig}
+		s.serve(adminSrv, adminListeners, errs)
+		defer adminSrv.Close()
+	}
+
+	if s.cfg.UseTLS() && s.cfg.RedirectPort != 0 {
+		go s.redirectHTTP(tlsPort(listeners, s.cfg.Port))
+	}
+
+	return <-errs
+}
+
+func (s *WsServer) tlsConfig() (*tls.Config, error) {
+	if !s.cfg.UseTLS() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.cfg.ClientCA != "" {
+		pool, err := common.LoadCertPool(s.cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// serve starts `srv` on each listener, sending the result to `errs` when it stops.
+func (s *WsServer) serve(srv *http.Server, listeners []net.Listener, errs chan<- error) {
+	for _, l := range listeners {
+		go func() {
+			// unix sockets are local only and always served without TLS
+			if s.cfg.UseTLS() && !isUnix(l) {
+				log.Debugf("server listening on %v (tls)", l.Addr())
+				errs <- srv.ServeTLS(l, s.cfg.TLSCert, s.cfg.TLSKey)
+			} else {
+				log.Debugf("server listening on %v", l.Addr())
+				errs <- srv.Serve(l)
+			}
+		}()
+	}
+}
+
+// tlsPort finds the port of the first TCP listener, which is used as the redirect
+// target for plain HTTP requests.
+func tlsPort(listeners []net.Listener, fallback uint16) uint16 {
+	for _, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return uint16(addr.Port)
+		}
+	}
+
+	return fallback
+}
+
+// redirectHTTP serves plain HTTP on the redirect port, sending every request to the
+// same path on the TLS port.
+func (s *WsServer) redirectHTTP(port uint16) {
+	addr := fmt.Sprintf(":%v", s.cfg.RedirectPort)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		u := url.URL{
+			Scheme:   "https",
+			Host:     net.JoinHostPort(host, strconv.Itoa(int(port))),
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+
+	log.Debugf("redirecting http on %v to https", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Errorf("http redirect listener: %v", err)
+	}
 }
 
 func (s *WsServer) serveWS(w http.ResponseWriter, r *http.Request) {
-	log.Debugf("websocket request from: %v", r.RemoteAddr)
+	log.Debug("websocket request", "remote", r.RemoteAddr)
 
 	key := r.URL.Query().Get("otp")
-	if key == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+	otp, ok := s.redeemOtp(key)
+	if !ok {
+		s.metrics.authFailures.Inc("otp")
+		writeError(w, r, errUnauthorized("Invalid or expired one-time password"))
 		return
 	}
-
-	otp, ok := s.otps[key]
-	if !ok || !otp.Validate(key) {
-		w.WriteHeader(http.StatusUnauthorized)
+	s.metrics.otpRedeemed.Add(1)
+	if b := s.checkBan(otp.user, r); b != nil {
+		writeError(w, r, errBanned(b))
 		return
 	}
-	delete(s.otps, key)
 
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Error(err, *r)
+		log.Error("websocket upgrade failed", "err", err, "remote", r.RemoteAddr, "user", otp.user)
 		if conn != nil {
 			conn.Close()
 		}
 		return
 	}
 
-	log.Debugf("upgraded to websocket: %v", conn.RemoteAddr())
-	go s.handle(NewPeer(conn))
+	log.Debug("upgraded to websocket", "remote", conn.RemoteAddr(), "user", otp.user)
+	go s.handle(NewPeer(conn, otp.user, s))
 }
 
-func (s *WsServer) authOTP(w http.ResponseWriter, r *http.Request) {
+// redeemOtp removes the OTP from the server, returning true if it was valid.
+func (s *WsServer) redeemOtp(key string) (*Otp, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	otp, ok := s.otps[key]
+	if !ok {
+		return nil, false
+	}
+	delete(s.otps, key)
+
+	return otp, otp.Validate(key)
+}
+
+// authenticate identifies the user making a request, first by a verified client
+// certificate and then by Basic auth credentials.
+func (s *WsServer) authenticate(r *http.Request) (string, bool) {
+	if user, ok := s.certUser(r); ok {
+		return user, true
+	}
+
 	user, pass, ok := r.BasicAuth()
-	if !ok || !s.db.AuthUser(user, pass) {
+	return user, ok && s.db.AuthUser(user, pass)
+}
+
+// certUser maps a verified client certificate to a user by its subject CN, then by its
+// DNS and email SANs.
+func (s *WsServer) certUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if s.db.UserExists(name) {
+			log.Debugf("client certificate `%s` maps to user `%s`", cert.Subject, name)
+			return name, true
+		}
+	}
+
+	log.Warnf("client certificate `%s` does not match any user", cert.Subject)
+	return "", false
+}
+
+func (s *WsServer) authOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(r)
+	if !ok {
 		log.Warnf("REJECT unauthorized user `%s` from %v", user, r.RemoteAddr)
-		w.WriteHeader(http.StatusUnauthorized)
+		s.metrics.authFailures.Inc("password")
+		s.audit(common.AUDIT_LOGIN_FAILED, user, user, r.RemoteAddr, "websocket login")
+		writeError(w, r, errUnauthorized("Invalid credentials"))
+		return
+	}
+
+	if b := s.checkBan(user, r); b != nil {
+		writeError(w, r, errBanned(b))
 		return
 	}
 
 	log.Infof("ACCEPT authorized user `%s` from %v", user, r.RemoteAddr)
-	otp := NewOtp()
-	log.Debugf("creating OTP for %v: %v", r.RemoteAddr, otp.value)
+	s.audit(common.AUDIT_LOGIN, user, user, r.RemoteAddr, "websocket login")
+	otp := NewOtp(user)
+	log.Debug("creating OTP", "user", user, "remote", r.RemoteAddr, "otp", common.Fingerprint(otp.value))
+	s.Lock()
 	s.otps[otp.value] = otp
+	s.Unlock()
+	s.metrics.otpIssued.Add(1)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(otp.value))
 }
 
+// add registers a peer, announcing the user as online if it is their first session or
+// they were idle.
 func (s *WsServer) add(p *Peer) {
-	s.Lock()
-	defer s.Unlock()
+	msg, err := s.db.StatusMessage(p.user)
+	if err != nil {
+		p.logger.Error("failed to load status message", "err", err)
+	}
 
+	s.Lock()
+	first := s.sessions(p.user) == 0
 	s.peers[p] = struct{}{}
+	if first {
+		s.presence[p.user] = &presenceState{status: common.PRESENCE_ONLINE, message: msg}
+	}
+	s.metrics.connects.Add(1)
+	s.Unlock()
+
+	s.webhooks.dispatch(common.HOOK_CONNECT, p.Info(), nil)
+	if first {
+		s.publish(common.Event{Type: common.EVENT_PRESENCE, User: p.user, Status: common.PRESENCE_ONLINE, Text: msg})
+	} else {
+		s.refreshPresence(p.user, false)
+	}
 }
 
+// remove closes and unregisters a peer, announcing the user as offline if it was their
+// last session.
 func (s *WsServer) remove(p *Peer) {
 	s.Lock()
-	defer s.Unlock()
-
-	if _, ok := s.peers[p]; ok {
-		log.Debugf("removing client: %v", p.Name())
-		p.conn.Close()
+	_, ok := s.peers[p]
+	if ok {
+		p.logger.Debug("removing client")
+		p.close()
 		delete(s.peers, p)
+		s.metrics.disconnects.Add(1)
+	}
+	last := ok && s.sessions(p.user) == 0
+	if last {
+		delete(s.presence, p.user)
 	}
+	s.Unlock()
+
+	if !ok {
+		return
+	}
+	s.webhooks.dispatch(common.HOOK_DISCONNECT, p.Info(), nil)
+	s.signals.disconnect(p, last)
+	if last {
+		s.markSeen(p.user)
+		s.publish(common.Event{Type: common.EVENT_PRESENCE, User: p.user, Status: common.PRESENCE_OFFLINE})
+	} else {
+		// the remaining sessions may all be idle
+		s.refreshPresence(p.user, false)
+	}
+}
+
+// sessions counts the connected peers of a user, it must be called with the server
+// lock held.
+func (s *WsServer) sessions(user string) int {
+	n := 0
+	for p := range s.peers {
+		if p.user == user {
+			n++
+		}
+	}
+	return n
+}
+
+// findPeer returns the connected peer with the given id, or nil if there is none.
+func (s *WsServer) findPeer(id string) *Peer {
+	s.RLock()
+	defer s.RUnlock()
+
+	for p := range s.peers {
+		if p.id == id {
+			return p
+		}
+	}
+
+	return nil
 }
 
 func (s *WsServer) handle(p *Peer) {
 	s.add(p)
 	defer s.remove(p)
 
-	p.recv()
+	s.deliverQueued(p)
+	go p.writeLoop()
+	p.recv(s.route)
 }
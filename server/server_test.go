@@ -0,0 +1,53 @@
+package server
+
+import (
+	"hello-go/common"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+// newTestServer returns a server without listeners, backed by a new database with the
+// seeded users in a temporary directory.
+func newTestServer(t *testing.T, cfg Config) *WsServer {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "db.sqlite")
+	db, err := common.NewDatabase(path, os.DirFS(".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reopened like the server does, since pragmas set by the migrations only apply to
+	// the connection which ran them
+	db.Close()
+	if db, err = common.OpenDatabase(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = db
+	s.webhooks = newDispatcher(db, 1, 0)
+	s.signals = newSignals(s.relaySignal)
+	return s
+}
+
+// testPeer connects a session of `user` without a websocket, the packets sent to it are
+// buffered in its write queue.
+func testPeer(s *WsServer, user string) *Peer {
+	p := &Peer{
+		user:   user,
+		logger: log.With("user", user),
+		tx:     make(chan common.Packet, writeQueueSize),
+		done:   make(chan struct{}),
+	}
+	s.Lock()
+	s.peers[p] = struct{}{}
+	s.Unlock()
+	return p
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"hello-go/common"
+	"sync"
+	"time"
+)
+
+const (
+	// typingDebounce is the shortest interval between relayed typing signals of a user
+	// in one conversation, since clients may send one on every keystroke.
+	typingDebounce = 3 * time.Second
+	// typingTimeout stops a user typing when no typing signal was received for this long.
+	typingTimeout = 8 * time.Second
+	// readDebounce is the shortest interval between relayed read cursors of a user in
+	// one conversation. Cursors received in between are coalesced into the latest.
+	readDebounce = time.Second
+)
+
+// signalKey is a user in a room or direct conversation.
+type signalKey struct {
+	user string
+	room string
+	to   string
+}
+
+func keyOf(sig common.Signal) signalKey {
+	return signalKey{user: sig.User, room: sig.Room, to: sig.To}
+}
+
+func (k signalKey) signal() common.Signal {
+	return common.Signal{User: k.user, Room: k.room, To: k.to}
+}
+
+type typingState struct {
+	// peer is the session which last sent a typing signal
+	peer    *Peer
+	sent    time.Time
+	expires time.Time
+	timer   *time.Timer
+}
+
+type readState struct {
+	cursor  int64
+	sent    time.Time
+	pending int64
+	// timer flushes the pending cursor, it is nil when nothing is pending
+	timer *time.Timer
+}
+
+// signals debounces ephemeral signals before they are relayed, and stops typing when
+// a user goes silent. Nothing is stored, state only lasts while the user is connected.
+type signals struct {
+	sync.Mutex
+	typing map[signalKey]*typingState
+	read   map[signalKey]*readState
+	// relay sends a signal to its recipients, `from` is the sending session or nil
+	relay func(ty string, sig common.Signal, from *Peer)
+
+	typingDebounce time.Duration
+	typingTimeout  time.Duration
+	readDebounce   time.Duration
+}
+
+func newSignals(relay func(string, common.Signal, *Peer)) *signals {
+	return &signals{
+		typing:         make(map[signalKey]*typingState),
+		read:           make(map[signalKey]*readState),
+		relay:          relay,
+		typingDebounce: typingDebounce,
+		typingTimeout:  typingTimeout,
+		readDebounce:   readDebounce,
+	}
+}
+
+// startTyping relays that a user started typing, unless it was relayed less than
+// typingDebounce ago, and extends when they stop typing.
+func (sg *signals) startTyping(p *Peer, sig common.Signal) {
+	key := keyOf(sig)
+	now := time.Now()
+
+	sg.Lock()
+	st, ok := sg.typing[key]
+	if !ok {
+		st = &typingState{}
+		st.timer = time.AfterFunc(sg.typingTimeout, func() { sg.expire(key, st) })
+		sg.typing[key] = st
+	} else {
+		st.timer.Reset(sg.typingTimeout)
+	}
+	st.peer = p
+	st.expires = now.Add(sg.typingTimeout)
+	send := now.Sub(st.sent) >= sg.typingDebounce
+	if send {
+		st.sent = now
+	}
+	sg.Unlock()
+
+	if send {
+		sg.relay(common.PACKET_TYPING, key.signal(), p)
+	}
+}
+
+// stopTyping relays that a user stopped typing, if they were typing.
+func (sg *signals) stopTyping(key signalKey, from *Peer) {
+	sg.Lock()
+	st, ok := sg.typing[key]
+	if ok {
+		st.timer.Stop()
+		delete(sg.typing, key)
+	}
+	sg.Unlock()
+
+	if ok {
+		sg.relay(common.PACKET_TYPING_STOP, key.signal(), from)
+	}
+}
+
+// expire stops typing once typingTimeout passed without a typing signal.
+func (sg *signals) expire(key signalKey, st *typingState) {
+	sg.Lock()
+	expired := sg.typing[key] == st && !time.Now().Before(st.expires)
+	if expired {
+		delete(sg.typing, key)
+	}
+	sg.Unlock()
+
+	if expired {
+		sg.relay(common.PACKET_TYPING_STOP, key.signal(), nil)
+	}
+}
+
+// markRead relays a read cursor, coalescing cursors received within readDebounce of
+// the last one relayed. Cursors never move backwards.
+func (sg *signals) markRead(p *Peer, sig common.Signal) {
+	key := keyOf(sig)
+	now := time.Now()
+
+	sg.Lock()
+	st, ok := sg.read[key]
+	if !ok {
+		st = &readState{}
+		sg.read[key] = st
+	}
+	if sig.MessageId <= max(st.cursor, st.pending) {
+		sg.Unlock()
+		return
+	}
+	wait := sg.readDebounce - now.Sub(st.sent)
+	if wait <= 0 && st.timer == nil {
+		st.cursor = sig.MessageId
+		st.sent = now
+		sg.Unlock()
+		sg.relay(common.PACKET_READ, sig, p)
+		return
+	}
+	st.pending = sig.MessageId
+	if st.timer == nil {
+		st.timer = time.AfterFunc(wait, func() { sg.flushRead(key, st) })
+	}
+	sg.Unlock()
+}
+
+func (sg *signals) flushRead(key signalKey, st *readState) {
+	sg.Lock()
+	sig := key.signal()
+	sig.MessageId = st.pending
+	st.cursor = st.pending
+	st.pending = 0
+	st.sent = time.Now()
+	st.timer = nil
+	sg.Unlock()
+
+	sg.relay(common.PACKET_READ, sig, nil)
+}
+
+// disconnect stops typing in the conversations where the session was typing, and
+// forgets the read cursors of the user once their last session is gone.
+func (sg *signals) disconnect(p *Peer, last bool) {
+	var stopped []signalKey
+	sg.Lock()
+	for key, st := range sg.typing {
+		if st.peer == p || (last && key.user == p.user) {
+			st.timer.Stop()
+			delete(sg.typing, key)
+			stopped = append(stopped, key)
+		}
+	}
+	if last {
+		for key, st := range sg.read {
+			if key.user == p.user && st.timer == nil {
+				delete(sg.read, key)
+			}
+		}
+	}
+	sg.Unlock()
+
+	for _, key := range stopped {
+		sg.relay(common.PACKET_TYPING_STOP, key.signal(), nil)
+	}
+}
+
+// checkSignal validates a signal from `user`, who must be a member of its room.
+func (s *WsServer) checkSignal(user string, ty string, sig common.Signal) (common.Signal, error) {
+	sig.User = user
+
+	var v validation
+	v.check((sig.Room == "") != (sig.To == ""), "room", "exactly one of room or to is required")
+	v.check(sig.To != user, "to", "cannot signal yourself")
+	v.check(ty != common.PACKET_READ || sig.MessageId > 0, "message_id", "message_id is required")
+	if sig.Room != "" {
+		room, err := common.NormalizeRoom(sig.Room)
+		if err != nil {
+			v.add("room", "%v", err)
+		}
+		sig.Room = room
+	}
+	if err := v.err(); err != nil {
+		return sig, err
+	}
+
+	if sig.Room != "" {
+		s.RLock()
+		member := s.isMember(sig.Room, user)
+		s.RUnlock()
+		if !member {
+			return sig, errForbidden("not a member of #%s", sig.Room)
+		}
+	}
+	return sig, nil
+}
+
+// relaySignal sends a signal to the members of its room or the partner of its direct
+// conversation, except the sending session. The user's other sessions also receive
+// read cursors, so they can mark the conversation as read.
+func (s *WsServer) relaySignal(ty string, sig common.Signal, from *Peer) {
+	packet := common.NewJSONPacket(ty, sig)
+
+	s.RLock()
+	defer s.RUnlock()
+	for p := range s.peers {
+		var ok bool
+		switch {
+		case p == from:
+		case p.user == sig.User:
+			ok = ty == common.PACKET_READ
+		case sig.Room != "":
+			ok = s.isMember(sig.Room, p.user)
+		default:
+			ok = p.user == sig.To
+		}
+		if ok {
+			p.send(packet)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"hello-go/common"
+	"testing"
+	"time"
+)
+
+type relayed struct {
+	ty  string
+	sig common.Signal
+}
+
+func newTestSignals(debounce time.Duration, timeout time.Duration) (*signals, chan relayed) {
+	ch := make(chan relayed, 16)
+	sg := newSignals(func(ty string, sig common.Signal, from *Peer) {
+		ch <- relayed{ty, sig}
+	})
+	sg.typingDebounce = debounce
+	sg.typingTimeout = timeout
+	sg.readDebounce = debounce
+	return sg, ch
+}
+
+func TestTypingIsDebouncedAndExpires(t *testing.T) {
+	sg, ch := newTestSignals(time.Hour, 50*time.Millisecond)
+	p := &Peer{user: "bob"}
+	sig := common.Signal{User: "bob", Room: "dev"}
+
+	for range 5 {
+		sg.startTyping(p, sig)
+	}
+	if r := receive(t, ch); r.ty != common.PACKET_TYPING || r.sig != sig {
+		t.Errorf("relayed %+v, want typing in #dev", r)
+	}
+	if r := receive(t, ch); r.ty != common.PACKET_TYPING_STOP || r.sig != sig {
+		t.Errorf("relayed %+v, want typing stopped after the timeout", r)
+	}
+	if len(ch) != 0 {
+		t.Errorf("relayed %d extra signals", len(ch))
+	}
+
+	sg.stopTyping(keyOf(sig), p)
+	if len(ch) != 0 {
+		t.Error("relayed stop for a user who was not typing")
+	}
+}
+
+func TestDisconnectStopsTyping(t *testing.T) {
+	sg, ch := newTestSignals(time.Hour, time.Hour)
+	phone, laptop := &Peer{user: "bob"}, &Peer{user: "bob"}
+
+	sg.startTyping(phone, common.Signal{User: "bob", To: "alice"})
+	sg.startTyping(laptop, common.Signal{User: "bob", Room: "dev"})
+	receive(t, ch)
+	receive(t, ch)
+
+	sg.disconnect(phone, false)
+	if r := receive(t, ch); r.ty != common.PACKET_TYPING_STOP || r.sig.To != "alice" {
+		t.Errorf("relayed %+v, want typing to alice stopped", r)
+	}
+	if len(ch) != 0 {
+		t.Error("stopped typing in a conversation of another session")
+	}
+}
+
+func TestReadCursorsAreCoalesced(t *testing.T) {
+	sg, ch := newTestSignals(50*time.Millisecond, time.Hour)
+	p := &Peer{user: "bob"}
+	read := func(id int64) { sg.markRead(p, common.Signal{User: "bob", To: "alice", MessageId: id}) }
+
+	read(3)
+	read(5)
+	read(4)
+	read(9)
+	read(2)
+	for _, want := range []int64{3, 9} {
+		if r := receive(t, ch); r.ty != common.PACKET_READ || r.sig.MessageId != want {
+			t.Errorf("relayed %+v, want read cursor %d", r, want)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(ch) != 0 {
+		t.Errorf("relayed %d extra read cursors", len(ch))
+	}
+}
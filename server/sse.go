@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hello-go/common"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sseKeepAlive is how often a comment is written to idle streams so proxies do
+	// not close them.
+	sseKeepAlive = 15 * time.Second
+	// sseRetry is the reconnection delay suggested to clients.
+	sseRetry = 3 * time.Second
+)
+
+// apiEvents streams the events the user would receive on a websocket as Server-Sent
+// Events. The `room` query parameter (repeatable or comma separated) limits the stream
+// to room events, and a `Last-Event-ID` header or `last_event_id` parameter resumes
+// after the given event while it is still buffered.
+func (s *WsServer) apiEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("response writer does not support flushing"))
+		return
+	}
+
+	sub := &subscriber{user: requestUser(r)}
+	q := r.URL.Query()
+	for _, v := range q["room"] {
+		for _, name := range strings.Split(v, ",") {
+			room, err := common.NormalizeRoom(name)
+			if err != nil {
+				writeError(w, r, errInvalidField("room", "%v", err))
+				return
+			}
+			sub.rooms = append(sub.rooms, room)
+		}
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = q.Get("last_event_id")
+	}
+	var last uint64
+	if lastId != "" {
+		var err error
+		if last, err = strconv.ParseUint(lastId, 10, 64); err != nil {
+			writeError(w, r, errInvalidField("Last-Event-ID", "invalid event id `%s`", lastId))
+			return
+		}
+	}
+
+	backlog := s.subscribe(sub, last)
+	defer s.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	for _, e := range backlog {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-sub.ch:
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-sub.dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e common.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+	return err
+}
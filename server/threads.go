@@ -0,0 +1,109 @@
+package server
+
+import (
+	"hello-go/common"
+	"net/http"
+	"strconv"
+)
+
+// threadRoot returns the root of the thread of a message visible to `user`. Threads
+// are flat, so a reply to a reply belongs to the thread of its parent.
+func (s *WsServer) threadRoot(id int64, user string) (*common.Message, error) {
+	m, err := s.db.GetMessage(id, user)
+	if err != nil || m == nil || m.ParentId == 0 {
+		return m, err
+	}
+	return s.db.GetMessage(m.ParentId, user)
+}
+
+// inThread makes a text a reply in the thread of its ParentId, sending it to the
+// conversation of the thread. A room or recipient set by the client must match it.
+func (s *WsServer) inThread(user string, t *common.Text) error {
+	m, err := s.threadRoot(t.ParentId, user)
+	switch {
+	case err != nil:
+		return err
+	case m == nil:
+		return errInvalidField("parent_id", "message %d not found", t.ParentId)
+	case m.Deleted != nil:
+		return errInvalidField("parent_id", "message %d was deleted", m.Id)
+	}
+
+	room, to := m.Room, m.To
+	if to == user {
+		to = m.From
+	}
+	if (t.Room != "" || t.To != "") && (t.Room != room || t.To != to) {
+		return errInvalidField("parent_id", "replies to message %d must be sent to its conversation", m.Id)
+	}
+	t.ParentId, t.Room, t.To = m.Id, room, to
+	return nil
+}
+
+// thread returns the thread of a message visible to `user` with a page of its
+// replies. Deleted roots are returned as tombstones so their replies remain readable.
+func (s *WsServer) thread(user string, id int64, before int64, limit int) (*common.Thread, error) {
+	m, err := s.threadRoot(id, user)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errNotFound("message %d not found", id)
+	}
+
+	replies, err := s.db.GetMessages(common.MessageFilter{Viewer: user, Parent: m.Id, BeforeId: before, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	t := &common.Thread{Parent: *m, Replies: replies}
+	if n := len(replies); n > 0 && n == limit {
+		t.NextBefore = replies[n-1].Id
+	}
+	return t, nil
+}
+
+func (s *WsServer) handleThread(p *Peer, packet *common.RawPacket) {
+	id, err := strconv.ParseInt(string(packet.Payload), 10, 64)
+	if err != nil {
+		p.notify("thread failed: invalid message id `%s`", packet.Payload)
+		return
+	}
+	t, err := s.thread(p.user, id, 0, common.MAX_MESSAGE_PAGE)
+	if err != nil {
+		p.notify("thread failed: %v", err)
+		return
+	}
+	p.send(common.NewJSONPacket(common.PACKET_THREAD, t))
+}
+
+// apiGetThread returns a message with its replies, newest first. `before` and `limit`
+// page through older replies. The id of a reply returns the thread it belongs to.
+func (s *WsServer) apiGetThread(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var v validation
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	v.check(err == nil && id > 0, "id", "invalid message id `%s`", r.PathValue("id"))
+	var before int64
+	if b := q.Get("before"); b != "" {
+		before, err = strconv.ParseInt(b, 10, 64)
+		v.check(err == nil && before > 0, "before", "invalid `before` id `%s`", b)
+	}
+	limit := common.MAX_MESSAGE_PAGE
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		v.check(err == nil && limit > 0, "limit", "invalid `limit` `%s`", l)
+		limit = min(limit, common.MAX_MESSAGE_PAGE)
+	}
+	if err := v.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	t, err := s.thread(requestUser(r), id, before, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t)
+}
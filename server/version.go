@@ -0,0 +1,27 @@
+package server
+
+import "runtime/debug"
+
+// Version is the server version, set at build time with
+// `-ldflags "-X hello-go/server.Version=v1.2.3"`.
+var Version = "dev"
+
+// buildInfo reports the Go version and VCS details embedded in the binary.
+func buildInfo() map[string]string {
+	info := map[string]string{}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info["go"] = bi.GoVersion
+	info["module"] = bi.Main.Path
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			info[s.Key] = s.Value
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hello-go/common"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/matoous/go-nanoid/v2"
+)
+
+const (
+	webhookQueueSize = 256
+	webhookWorkers   = 4
+	webhookTimeout   = 10 * time.Second
+
+	// Headers sent with every webhook request. The signature is the hex HMAC-SHA256 of
+	// `<timestamp>.<body>` keyed with the webhook secret, prefixed with `sha256=`.
+	HEADER_WEBHOOK_ID        = "X-Webhook-Id"
+	HEADER_WEBHOOK_EVENT     = "X-Webhook-Event"
+	HEADER_WEBHOOK_TIMESTAMP = "X-Webhook-Timestamp"
+	HEADER_WEBHOOK_SIGNATURE = "X-Webhook-Signature"
+)
+
+// webhookPayload is the JSON body POSTed to webhooks. Id is the same for every attempt
+// to deliver the payload, so receivers can ignore retries they already processed.
+type webhookPayload struct {
+	Id    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+// delivery is a payload queued for one webhook.
+type delivery struct {
+	hook    common.Webhook
+	id      string
+	event   string
+	body    []byte
+	attempt int
+}
+
+// deliveryLog records delivery attempts and undeliverable payloads, it is implemented
+// by common.Database.
+type deliveryLog interface {
+	LogDelivery(*common.WebhookDelivery) error
+	DeadLetter(*common.DeadLetter) error
+}
+
+// dispatcher delivers events to webhooks in the background. Failed deliveries are
+// retried with exponential backoff, and moved to the dead-letter table once `attempts`
+// have failed.
+type dispatcher struct {
+	sync.RWMutex
+	hooks    []common.Webhook
+	queue    chan *delivery
+	client   *http.Client
+	log      deliveryLog
+	attempts int
+	backoff  time.Duration
+}
+
+func newDispatcher(log deliveryLog, attempts int, backoff time.Duration) *dispatcher {
+	return &dispatcher{
+		queue:    make(chan *delivery, webhookQueueSize),
+		client:   &http.Client{Timeout: webhookTimeout},
+		log:      log,
+		attempts: max(attempts, 1),
+		backoff:  backoff,
+	}
+}
+
+func (d *dispatcher) start() {
+	for range webhookWorkers {
+		go func() {
+			for dl := range d.queue {
+				d.deliver(dl)
+			}
+		}()
+	}
+}
+
+func (d *dispatcher) setHooks(hooks []common.Webhook) {
+	d.Lock()
+	defer d.Unlock()
+	d.hooks = hooks
+}
+
+func (d *dispatcher) find(id int64) (common.Webhook, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, h := range d.hooks {
+		if h.Id == id {
+			return h, true
+		}
+	}
+	return common.Webhook{}, false
+}
+
+// dispatch queues an event for every webhook subscribed to it. `m` is the message for
+// message events and nil otherwise.
+func (d *dispatcher) dispatch(event string, data any, m *common.Message) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, h := range d.hooks {
+		if !h.Wants(event, m) {
+			continue
+		}
+
+		id, err := gonanoid.New()
+		if err != nil {
+			log.Error("failed to generate webhook delivery id", "err", err, "webhook", h.Id)
+			continue
+		}
+		body, err := json.Marshal(webhookPayload{Id: id, Event: event, Time: time.Now(), Data: data})
+		if err != nil {
+			log.Error("failed to encode webhook payload", "err", err, "event", event, "webhook", h.Id)
+			continue
+		}
+		d.enqueue(&delivery{hook: h, id: id, event: event, body: body})
+	}
+}
+
+// enqueue adds a delivery to the queue, dead-lettering it if the queue is full.
+func (d *dispatcher) enqueue(dl *delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		d.deadLetter(dl, "delivery queue is full")
+	}
+}
+
+// deliver makes one attempt to deliver the payload, scheduling a retry on failure.
+func (d *dispatcher) deliver(dl *delivery) {
+	dl.attempt++
+	start := time.Now()
+	status, err := d.post(dl)
+
+	entry := &common.WebhookDelivery{
+		WebhookId:  dl.hook.Id,
+		Delivery:   dl.id,
+		Event:      dl.event,
+		Attempt:    dl.attempt,
+		Time:       start,
+		Status:     status,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := d.log.LogDelivery(entry); err != nil {
+		log.Error("failed to log webhook delivery", "err", err, "webhook", dl.hook.Id)
+	}
+	if err == nil {
+		return
+	}
+
+	if dl.attempt >= d.attempts {
+		log.Warn("webhook delivery failed", "webhook", dl.hook.Id, "event", dl.event, "attempts", dl.attempt, "err", err)
+		d.deadLetter(dl, err.Error())
+		return
+	}
+	delay := d.backoff << (dl.attempt - 1)
+	log.Debug("retrying webhook delivery", "webhook", dl.hook.Id, "attempt", dl.attempt, "delay", delay, "err", err)
+	time.AfterFunc(delay, func() {
+		// the webhook may have been deleted or changed while waiting
+		h, ok := d.find(dl.hook.Id)
+		if !ok {
+			log.Debug("dropping retry of a deleted webhook", "webhook", dl.hook.Id, "delivery", dl.id)
+			return
+		}
+		dl.hook = h
+		d.enqueue(dl)
+	})
+}
+
+// post sends the signed payload, returning the response status. Any status other than
+// 2xx is an error.
+func (d *dispatcher) post(dl *delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.hook.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hello-go/"+Version)
+	req.Header.Set(HEADER_WEBHOOK_ID, dl.id)
+	req.Header.Set(HEADER_WEBHOOK_EVENT, dl.event)
+	req.Header.Set(HEADER_WEBHOOK_TIMESTAMP, ts)
+	req.Header.Set(HEADER_WEBHOOK_SIGNATURE, signWebhook(dl.hook.Secret, ts, dl.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (d *dispatcher) deadLetter(dl *delivery, reason string) {
+	err := d.log.DeadLetter(&common.DeadLetter{
+		WebhookId: dl.hook.Id,
+		Delivery:  dl.id,
+		Event:     dl.event,
+		Payload:   string(dl.body),
+		Attempts:  dl.attempt,
+		Error:     reason,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		log.Error("failed to store webhook dead letter", "err", err, "webhook", dl.hook.Id, "delivery", dl.id)
+	}
+}
+
+// signWebhook returns the signature header value for a payload.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadWebhooks reads the webhooks from the database into the dispatcher.
+func (s *WsServer) loadWebhooks() error {
+	hooks, err := s.db.GetWebhooks()
+	if err != nil {
+		return err
+	}
+	s.webhooks.setHooks(hooks)
+	return nil
+}
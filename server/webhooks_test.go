@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"hello-go/common"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryLog is a deliveryLog which reports to channels instead of the database.
+type memoryLog struct {
+	deliveries chan common.WebhookDelivery
+	dead       chan common.DeadLetter
+}
+
+func newMemoryLog() *memoryLog {
+	return &memoryLog{
+		deliveries: make(chan common.WebhookDelivery, 16),
+		dead:       make(chan common.DeadLetter, 16),
+	}
+}
+
+func (l *memoryLog) LogDelivery(d *common.WebhookDelivery) error {
+	l.deliveries <- *d
+	return nil
+}
+
+func (l *memoryLog) DeadLetter(d *common.DeadLetter) error {
+	l.dead <- *d
+	return nil
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting to receive")
+		panic("unreachable")
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	const secret = "0123456789abcdef"
+	bodies := make(chan []byte, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signWebhook(secret, r.Header.Get(HEADER_WEBHOOK_TIMESTAMP), body)
+		if got := r.Header.Get(HEADER_WEBHOOK_SIGNATURE); got != want {
+			t.Errorf("signature is %q, want %q", got, want)
+		}
+		if got := r.Header.Get(HEADER_WEBHOOK_EVENT); got != common.HOOK_MESSAGE {
+			t.Errorf("event header is %q, want %q", got, common.HOOK_MESSAGE)
+		}
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	l := newMemoryLog()
+	d := newDispatcher(l, 1, time.Millisecond)
+	d.setHooks([]common.Webhook{{
+		Id: 1, URL: srv.URL, Secret: secret, Events: []string{common.HOOK_MESSAGE}, Room: "ci", Contains: "FAILED",
+	}})
+	d.start()
+
+	skipped := &common.Message{Id: 1, From: "bot", Room: "ci", Text: "build passed"}
+	d.dispatch(common.HOOK_MESSAGE, skipped, skipped)
+	d.dispatch(common.HOOK_CONNECT, obj{"user": "bot"}, nil)
+	m := &common.Message{Id: 2, From: "bot", Room: "ci", Text: "build failed"}
+	d.dispatch(common.HOOK_MESSAGE, m, m)
+
+	var payload struct {
+		Id    string         `json:"id"`
+		Event string         `json:"event"`
+		Data  common.Message `json:"data"`
+	}
+	if err := json.Unmarshal(receive(t, bodies), &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if payload.Event != common.HOOK_MESSAGE || payload.Data.Id != m.Id {
+		t.Errorf("received %+v, want message %d", payload, m.Id)
+	}
+
+	entry := receive(t, l.deliveries)
+	if entry.Status != http.StatusOK || entry.Error != "" || entry.Delivery != payload.Id {
+		t.Errorf("logged %+v, want a successful delivery of %s", entry, payload.Id)
+	}
+	select {
+	case body := <-bodies:
+		t.Errorf("unexpected delivery of filtered event: %s", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	l := newMemoryLog()
+	d := newDispatcher(l, 5, 10*time.Millisecond)
+	d.setHooks([]common.Webhook{{Id: 1, URL: srv.URL, Events: []string{common.HOOK_REGISTER}}})
+	d.start()
+	d.dispatch(common.HOOK_REGISTER, obj{"user": "carol"}, nil)
+
+	var prev common.WebhookDelivery
+	for attempt := 1; attempt <= 3; attempt++ {
+		entry := receive(t, l.deliveries)
+		if entry.Attempt != attempt {
+			t.Fatalf("logged attempt %d, want %d", entry.Attempt, attempt)
+		}
+		if attempt > 1 && entry.Delivery != prev.Delivery {
+			t.Errorf("retry has delivery id %s, want %s", entry.Delivery, prev.Delivery)
+		}
+		if wantOk := attempt == 3; (entry.Error == "") != wantOk {
+			t.Errorf("attempt %d logged status %d error %q", attempt, entry.Status, entry.Error)
+		}
+		prev = entry
+	}
+	if len(l.dead) != 0 {
+		t.Error("successful delivery was dead-lettered")
+	}
+}
+
+func TestWebhookDeadLettersAfterLastAttempt(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	l := newMemoryLog()
+	d := newDispatcher(l, 3, time.Millisecond)
+	d.setHooks([]common.Webhook{{Id: 7, URL: srv.URL, Events: []string{common.HOOK_DISCONNECT}}})
+	d.start()
+	d.dispatch(common.HOOK_DISCONNECT, obj{"user": "dave"}, nil)
+
+	dead := receive(t, l.dead)
+	if dead.WebhookId != 7 || dead.Attempts != 3 || dead.Event != common.HOOK_DISCONNECT {
+		t.Errorf("dead letter %+v, want webhook 7 after 3 attempts", dead)
+	}
+	if len(l.deliveries) != 3 {
+		t.Errorf("logged %d attempts, want 3", len(l.deliveries))
+	}
+}
+
+func TestWebhookRetriesStopWhenDeleted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	l := newMemoryLog()
+	d := newDispatcher(l, 3, 50*time.Millisecond)
+	d.setHooks([]common.Webhook{{Id: 7, URL: srv.URL, Events: []string{common.HOOK_DISCONNECT}}})
+	d.start()
+	d.dispatch(common.HOOK_DISCONNECT, obj{"user": "dave"}, nil)
+
+	receive(t, l.deliveries)
+	d.setHooks(nil)
+	time.Sleep(200 * time.Millisecond)
+	if len(l.deliveries) != 0 || len(l.dead) != 0 {
+		t.Errorf("logged %d retries and %d dead letters after the webhook was deleted", len(l.deliveries), len(l.dead))
+	}
+}
@@ -0,0 +1,17 @@
+DROP TABLE IF EXISTS bans;
+
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+
+-- `value` is a username for `user` bans and a CIDR prefix for `ip` bans, times are
+-- unix seconds and `expires` is NULL for permanent bans
+CREATE TABLE bans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL CHECK (kind IN ('user', 'ip')),
+    value TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    created INTEGER NOT NULL,
+    expires INTEGER
+);
+
+CREATE INDEX bans_kind_value ON bans(kind, value);
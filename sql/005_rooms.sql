@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS room_members;
+
+-- membership history, `left` is NULL while the user is a member, times are unix
+-- seconds
+CREATE TABLE room_members (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    room TEXT NOT NULL,
+    username TEXT NOT NULL,
+    joined INTEGER NOT NULL,
+    left INTEGER,
+    FOREIGN KEY(username) REFERENCES users(username) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX room_members_current ON room_members(room, username) WHERE left IS NULL;
+CREATE INDEX room_members_username ON room_members(username);
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS messages;
+
+-- `room` and `recipient` are empty for broadcasts, at most one of them is set. Times
+-- are unix seconds and rows are kept when the sender or recipient is deleted.
+CREATE TABLE messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL,
+    sender TEXT NOT NULL,
+    room TEXT NOT NULL DEFAULT '',
+    recipient TEXT NOT NULL DEFAULT '',
+    text TEXT NOT NULL
+);
+
+CREATE INDEX messages_room ON messages(room, id);
+CREATE INDEX messages_sender ON messages(sender, id);
+CREATE INDEX messages_recipient ON messages(recipient, id);
@@ -0,0 +1,47 @@
+DROP TABLE IF EXISTS webhook_dead_letters;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+
+-- `events` is a comma separated list of event names. `room`, `sender` and `contains`
+-- filter message events and are empty to match everything. Times are unix seconds.
+CREATE TABLE webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL,
+    room TEXT NOT NULL DEFAULT '',
+    sender TEXT NOT NULL DEFAULT '',
+    contains TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    created INTEGER NOT NULL
+);
+
+-- one row per delivery attempt, `status` is the HTTP response status or 0 when no
+-- response was received
+CREATE TABLE webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    delivery TEXT NOT NULL,
+    event TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    time INTEGER NOT NULL,
+    status INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
+
+-- payloads which failed every delivery attempt
+CREATE TABLE webhook_dead_letters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    delivery TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    error TEXT NOT NULL,
+    time INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_dead_letters_webhook ON webhook_dead_letters(webhook_id, id);
@@ -0,0 +1,15 @@
+DROP TABLE IF EXISTS incoming_webhooks;
+
+-- `username` is the default bot sender when a payload does not set one, times are
+-- unix seconds
+CREATE TABLE incoming_webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token TEXT NOT NULL UNIQUE,
+    room TEXT NOT NULL,
+    username TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    created INTEGER NOT NULL
+);
+
+-- bot messages are posted by incoming webhooks, their sender is not a user
+ALTER TABLE messages ADD COLUMN bot INTEGER NOT NULL DEFAULT 0;
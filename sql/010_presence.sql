@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS presence;
+
+-- last known presence of each user, `last_seen` is unix seconds
+CREATE TABLE presence (
+    username TEXT PRIMARY KEY,
+    message TEXT NOT NULL DEFAULT '',
+    last_seen INTEGER,
+    FOREIGN KEY(username) REFERENCES users(username) ON DELETE CASCADE
+);
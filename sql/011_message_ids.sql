@@ -0,0 +1,5 @@
+-- `client_id` is assigned by the sending client so retransmitted messages can be
+-- recognised, it is empty for messages without one
+ALTER TABLE messages ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX messages_client_id ON messages(sender, client_id) WHERE client_id != '';
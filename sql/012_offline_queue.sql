@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS offline_queue;
+
+-- direct messages waiting for their recipient to connect, delivered in id order and
+-- removed once delivered. `expires` is unix seconds
+CREATE TABLE offline_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    recipient TEXT NOT NULL,
+    expires INTEGER NOT NULL,
+    FOREIGN KEY(message_id) REFERENCES messages(id),
+    FOREIGN KEY(recipient) REFERENCES users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX offline_queue_recipient ON offline_queue(recipient, id);
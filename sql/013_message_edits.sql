@@ -0,0 +1,17 @@
+DROP TABLE IF EXISTS reactions;
+
+-- `edited` and `deleted` are unix seconds. Deleted messages are kept as tombstones
+-- with their text cleared
+ALTER TABLE messages ADD COLUMN edited INTEGER;
+ALTER TABLE messages ADD COLUMN deleted INTEGER;
+ALTER TABLE messages ADD COLUMN deleted_by TEXT NOT NULL DEFAULT '';
+
+-- each user reacts to a message at most once with each emoji
+CREATE TABLE reactions (
+    message_id INTEGER NOT NULL,
+    username TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    time INTEGER NOT NULL,
+    PRIMARY KEY(message_id, username, emoji),
+    FOREIGN KEY(message_id) REFERENCES messages(id)
+);
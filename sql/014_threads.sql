@@ -0,0 +1,5 @@
+-- replies reference the root message of their thread, which counts its replies
+ALTER TABLE messages ADD COLUMN parent_id INTEGER REFERENCES messages(id);
+ALTER TABLE messages ADD COLUMN replies INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX messages_parent ON messages(parent_id, id);